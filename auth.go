@@ -1,44 +1,75 @@
 package auth
 
 import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 	"reflect"
 )
 
-// TODO: timeout
-var verifs = map[string]UserId{}
-var verifsMu sync.Mutex
-
-func mkVerifTok(uid UserId) string {
-	verifsMu.Lock()
-	defer verifsMu.Unlock()
-	var tok string
-	for {
-		// XXX another constant perhaps?
-		tok = randString(C.LenUniq)
-		if _, ok := verifs[tok]; !ok {
-			break
-		}
+// TODO: expired (unused) tokens are never removed from the DB
+func (a *Auth) mkVerifTok(uid UserId) (string, error) {
+	// XXX another constant perhaps?
+	tok, err := randString(a.c.LenUniq)
+	if err != nil {
+		return "", err
+	}
+	if err := a.db.AddVerif(tok, uid, time.Now().Unix()); err != nil {
+		return "", &intErr{err.Error()}
+	}
+	return tok, nil
+}
+
+// Pop tok via pop, and make sure it's not older than timeout
+func tryTok(
+	pop func(string) (UserId, int64, error), tok string, timeout int64,
+) (UserId, error) {
+	uid, cdate, err := pop(tok)
+	if err != nil {
+		return -1, err
+	}
+	if cdate+timeout < time.Now().Unix() {
+		return -1, fmt.Errorf("Expired token")
+	}
+	return uid, nil
+}
+
+func (a *Auth) tryVerifTok(tok string) (UserId, error) {
+	return tryTok(a.db.PopVerif, tok, a.c.VerifTimeout)
+}
+
+// Create a verification token for uid and send it to email
+func (a *Auth) startVerif(uid UserId, email string) error {
+	tok, err := a.mkVerifTok(uid)
+	if err != nil {
+		return err
 	}
-	verifs[tok] = uid
-	return tok
+	return a.sendVerifEmail(email, tok)
 }
 
-func tryVerifTok(tok string) UserId {
-	verifsMu.Lock()
-	defer verifsMu.Unlock()
-	if uid, ok := verifs[tok]; ok {
-		delete(verifs, tok)
-		return uid
+// Same as startVerif(), for password resets
+func (a *Auth) startReset(uid UserId, email string) error {
+	tok, err := randString(a.c.LenUniq)
+	if err != nil {
+		return err
 	}
-	return -1
+	if err := a.db.AddReset(tok, uid, time.Now().Unix()); err != nil {
+		return &intErr{err.Error()}
+	}
+	return a.sendResetEmail(email, tok)
 }
 
 func (e *Email) UnmarshalJSON(data []byte) error {
@@ -52,27 +83,29 @@ func (e *Email) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// internal error (500)
-type intErr struct {
-	string
-}
-
-func (e *intErr) Error() string {
-	return e.string
-}
-
 type SomeErr struct {
 	Err string `json:"err"`
 }
 
 func fails(w http.ResponseWriter, err error) {
-	if _, ok := err.(*intErr); ok {
+	// NOTE: headers must be set before WriteHeader()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	switch err.(type) {
+	case *intErr:
 		w.WriteHeader(http.StatusInternalServerError)
-	} else {
+	case *authErr:
+		w.WriteHeader(http.StatusUnauthorized)
+	case *forbidErr:
+		w.WriteHeader(http.StatusForbidden)
+	case *mediaErr:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	case *limitErr:
+		w.WriteHeader(http.StatusTooManyRequests)
+	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	err2 := json.NewEncoder(w).Encode(&SomeErr{err.Error()})
 	if err2 != nil {
 		// XXX this will have to do for now
@@ -82,43 +115,63 @@ func fails(w http.ResponseWriter, err error) {
 }
 
 const (
-	CookieName = "token"
+	// Default cookie names
+	CookieName    = "token"
+	ConnectedName = "connected"
+	CSRFName      = "csrf"
 )
 
 // Reset the cookie token. This can be triggered e.g. when
 // the cookie becomes invalid.
-func RstCookie(w http.ResponseWriter) {
-	setCookie(w, "", -1)
+func (a *Auth) RstCookie(w http.ResponseWriter) {
+	a.setCookie(w, "", -1)
 }
 
-func setCookie(w http.ResponseWriter, tok string, d int) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     CookieName,
-		Value:    tok,
-		Path:     "/",
+func (a *Auth) mkCookie(name, value string, d int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     a.c.CookiePath,
+		Domain:   a.c.CookieDomain,
 		MaxAge:   d,
-		HttpOnly: true,
-	})
-	// TODO: untested (automatically)
+		Secure:   a.c.CookieSecure,
+		HttpOnly: httpOnly,
+		SameSite: a.sameSite,
+	}
+}
+
+func (a *Auth) setCookie(w http.ResponseWriter, tok string, d int) {
+	http.SetCookie(w, a.mkCookie(a.c.CookieName, tok, d, true))
+
+	// Double-submit token: read by JS, sent back as a header
+	if a.c.CSRF {
+		v := ""
+		if tok != "" {
+			v = csrfToken(tok)
+		}
+		http.SetCookie(w, a.mkCookie(a.c.CSRFName, v, d, false))
+	}
+
+	if a.c.NoConnected {
+		return
+	}
+
+	// Readable from JS, so that frontends know whether
+	// they're logged in.
 	c := "1"
 	if tok == "" {
 		c = "0"
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "connected",
-		Value:    c,
-		Path:     "/",
-		MaxAge:   d,
-		HttpOnly: false,
-	})
+	http.SetCookie(w, a.mkCookie(a.c.ConnectedName, c, d, false))
 }
 
-func SetCookie(w http.ResponseWriter, tok string) {
-	setCookie(w, tok, 3600*2)
+// Cookies live as long as the token they carry.
+func (a *Auth) SetCookie(w http.ResponseWriter, tok string) {
+	a.setCookie(w, tok, int(a.c.Timeout))
 }
 
-func GetCookie(w http.ResponseWriter, r *http.Request) (string, error) {
-	c, err := r.Cookie(CookieName)
+func (a *Auth) GetCookie(w http.ResponseWriter, r *http.Request) (string, error) {
+	c, err := r.Cookie(a.c.CookieName)
 	v := ""
 
 	// Should never happen I guess
@@ -132,6 +185,117 @@ func GetCookie(w http.ResponseWriter, r *http.Request) (string, error) {
 
 }
 
+const (
+	// Double-submit CSRF token header (see Config.CSRF)
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// The CSRF token is derived from the (HttpOnly) session token,
+// so that a cookie injected from e.g. a sibling subdomain
+// can't be used to forge one.
+func csrfToken(tok string) string {
+	h := sha256.Sum256([]byte("csrf:"+tok))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// Only requests with a JSON body are accepted.
+func checkJSON(r *http.Request) error {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || t != "application/json" {
+		return &mediaErr{"Content-Type must be application/json"}
+	}
+	return nil
+}
+
+// scheme://host[:port] of an Origin/Referer
+func originOf(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme+"://"+u.Host)
+}
+
+// When configured, browsers' requests must come from an allowed
+// origin. Requests with neither Origin nor Referer (non-browser
+// clients) are let through.
+func (a *Auth) checkOrigin(r *http.Request) error {
+	if len(a.c.Origins) == 0 {
+		return nil
+	}
+
+	o := r.Header.Get("Origin")
+	if o == "" {
+		o = r.Referer()
+	}
+	if o == "" {
+		return nil
+	}
+
+	// NOTE: "null" origins end up here
+	o = originOf(o)
+	for _, x := range a.c.Origins {
+		if o != "" && o == originOf(x) {
+			return nil
+		}
+	}
+	return &forbidErr{"Invalid origin"}
+}
+
+// Cookie-authenticated requests must carry the CSRF token
+// (when enabled).
+func (a *Auth) checkCSRF(r *http.Request, tok string) error {
+	if !a.c.CSRF {
+		return nil
+	}
+	h := r.Header.Get(CSRFHeader)
+	if subtle.ConstantTimeCompare([]byte(h), []byte(csrfToken(tok))) != 1 {
+		return &forbidErr{"Invalid CSRF token"}
+	}
+	return nil
+}
+
+// Authorization: Bearer <token>; "" if there's none
+func GetBearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+const (
+	// Set (to anything) by clients which only want the token
+	// in the JSON output, and no cookie (CLI, mobile apps, etc.)
+	NoCookieHeader = "Auth-No-Cookie"
+)
+
+// Retrieve the request's token, from the configured sources,
+// by order of precedence. The boolean is true if the token
+// comes from the Authorization header.
+func (a *Auth) getToken(w http.ResponseWriter, r *http.Request) (string, bool, error) {
+	for _, src := range a.c.TokenSources {
+		switch src {
+		case "bearer":
+			if tok := GetBearer(r); tok != "" {
+				return tok, true, nil
+			}
+		case "cookie":
+			tok, err := a.GetCookie(w, r)
+			if err != nil || tok != "" {
+				return tok, false, err
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// Should tokens be sent back as cookies? Not if configured so,
+// if asked by the client, or if the client used a bearer token.
+func (a *Auth) useCookie(r *http.Request, bearer bool) bool {
+	return !a.c.NoCookie && !bearer && r.Header.Get(NoCookieHeader) == ""
+}
+
 // Read the request's body as JSON
 func getJSONBody[T any](w http.ResponseWriter, r *http.Request, in *T) error {
 	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
@@ -152,14 +316,31 @@ func setJSONBody[T any](w http.ResponseWriter, r *http.Request, out T) error {
 	return err
 }
 
-// Test if a (struct of a given) type has a "Token" field
-func hasToken[T any](v *T) bool {
+// Test if a (struct of a given) type has a given field
+func hasField[T any](v *T, f string) bool {
 	x := reflect.ValueOf(v).Elem()
-	return x.FieldByName("Token") != reflect.Value{}
+	return x.FieldByName(f) != reflect.Value{}
+}
+
+func setField[T any](v *T, f, s string) {
+	reflect.ValueOf(v).Elem().FieldByName(f).SetString(s)
+}
+
+func getField[T any](v *T, f string) string {
+	return reflect.ValueOf(v).Elem().FieldByName(f).String()
+}
+
+// Client's IP address
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
 }
 
 // NOTE: "t" can be used as a context, a db connection, an aggregate
-// of both, etc.
+// of both, etc.; a determines where the token is read from/written to.
 //
 // NOTE: on the use of reflect: it's a bit clumsy, but avoids us to either
 //	- essentially, forward r, w to every function, so that they can
@@ -173,37 +354,65 @@ func hasToken[T any](v *T) bool {
 //
 // The current solution is a bit magical, but less invasive/clumsy.
 func Wrap[T, Tin, Tout any](
-	t T, f func(T, *Tin, *Tout) error,
+	a *Auth, t T, f func(T, *Tin, *Tout) error,
 ) func(http.ResponseWriter, *http.Request) {
-	var x Tin;  tokIn  := hasToken[Tin](&x)
-	var y Tout; tokOut := hasToken[Tout](&y)
+	var x Tin;  tokIn  := hasField[Tin](&x, "Token")
+	var y Tout; tokOut := hasField[Tout](&y, "Token")
+
+	// Client informations (sessions)
+	uaIn := hasField[Tin](&x, "UA")
+	ipIn := hasField[Tin](&x, "IP")
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		var in Tin; var out Tout; var err error
+		var bearer bool
+
+		// CSRF: cross-site forms can't send JSON
+		if err = checkJSON(r); err != nil {
+			goto Err
+		}
+
+		if err = a.checkOrigin(r); err != nil {
+			goto Err
+		}
 
 		if err = getJSONBody[Tin](w, r, &in); err != nil {
 			goto Err
 		}
 
 		if tokIn {
-			tok, err := GetCookie(w, r)
+			var tok string
+			tok, bearer, err = a.getToken(w, r)
 			if err != nil {
 				goto Err
 			}
-			reflect.ValueOf(&in).Elem().FieldByName("Token").SetString(tok)
+			if !bearer && tok != "" {
+				if err = a.checkCSRF(r, tok); err != nil {
+					goto Err
+				}
+			}
+			setField[Tin](&in, "Token", tok)
+		}
+
+		if uaIn {
+			setField[Tin](&in, "UA", r.UserAgent())
+		}
+		if ipIn {
+			setField[Tin](&in, "IP", a.clientIP(r))
 		}
 
 		if err = f(t, &in, &out); err != nil {
 			goto Err
 		}
 
-		if tokOut {
+		// NOTE: tokens are always in the JSON output anyway
+		if tokOut && a.useCookie(r, bearer) {
 			// TODO: cookie reseting vs. setting (max-age) isn't tested
-			tok := reflect.ValueOf(&out).Elem().FieldByName("Token").String()
+			tok := getField[Tout](&out, "Token")
 			if tok == "" {
-				RstCookie(w)
+				a.RstCookie(w)
 			} else {
-				SetCookie(w, tok)
+				a.SetCookie(w, tok)
 			}
 		}
 
@@ -225,18 +434,65 @@ func hash(passwd string) (string, error) {
 	return string(h), err
 }
 
-func Signin(db DB, in *SigninIn, out *SigninOut) error {
+// Compared against when there's no password to check, so that
+// Login() takes as long for unknown accounts (same cost as hash()).
+var dummyHash = sync.OnceValue(func() []byte {
+	h, err := hash("not-a-real-password")
+	if err != nil {
+		panic(err)
+	}
+	return []byte(h)
+})
+
+// Run f off the response path, e.g. so that the time it takes
+// doesn't tell whether an account exists; errors are logged.
+func (a *Auth) background(f func() error) {
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		if err := f(); err != nil {
+			log.Println(err)
+		}
+	}()
+}
+
+func checkPasswd(passwd string) error {
+	if len(passwd) < 10 {
+		return fmt.Errorf("Password too small")
+	}
+	return nil
+}
+
+// Check u's password (constant time)
+func matchPasswd(u *User, passwd string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(u.Passwd), []byte(passwd))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return fmt.Errorf("Invalid password")
+	} else if err != nil {
+		return &intErr{err.Error()}
+	}
+	return nil
+}
+
+func checkName(name string) error {
+	if len(name) < 3 {
+		return fmt.Errorf("Name too small")
+	}
+	return nil
+}
+
+func (a *Auth) Signin(in *SigninIn, out *SigninOut) error {
 	// encoding/json (just) manages basic JSON parsing, it's
 	// a bit simpler to do things here rather than extend
 	// the decoder up there
 	//
 	// Perhaps we'd want to have the full email check here too
 	// (the current error is clumsy "JSON parsing error" or so)
-	if len(in.Passwd) < 10 {
-		return fmt.Errorf("Password too small")
+	if err := checkPasswd(in.Passwd); err != nil {
+		return err
 	}
-	if len(in.Name) < 3 {
-		return fmt.Errorf("Name too small")
+	if err := checkName(in.Name); err != nil {
+		return err
 	}
 	if len(in.Email.string) < 3 {
 		return fmt.Errorf("Email too small")
@@ -250,23 +506,35 @@ func Signin(db DB, in *SigninIn, out *SigninOut) error {
 
 	// XXX rough/verbose error message
 	u := User{
-		0, in.Name, in.Email.string, in.Passwd, false, time.Now().UTC().Unix(),
+		0, in.Name, in.Email.string, in.Passwd, false, time.Now().UTC().Unix(), 0, 0,
+	}
+	err = a.db.AddUser(&u)
+	if errors.Is(err, ErrEmailUsed) && a.c.QuietSignin {
+		// Respond as on success; let the owner know instead
+		if err := a.sendSigninEmail(u.Email); err != nil {
+			log.Println(err)
+		}
+		return nil
 	}
-	if err := db.AddUser(&u); err != nil {
+	if err != nil {
 		return err
 	}
 
-	if C.NoVerif {
-		out.Token, err = NewToken(u.Id)
+	if a.c.NoVerif {
+		out.Token, err = a.NewToken(u.Id)
 		return err
 	}
 
-	tok := mkVerifTok(u.Id)
-
-	// TODO: send an email to the specified address.
-	// If so, we'll want to add a timer/restrictions to avoid
+	// TODO: we'll want to add a timer/restrictions to avoid
 	// being used to spam people. (e.g. allow n /signin per 24h at most)
-	fmt.Println(tok)
+	if err := a.startVerif(u.Id, u.Email); err != nil {
+		// The account couldn't be verified, and would keep
+		// its name/email from being registered again.
+		if _, err := a.db.RmUser(u.Id); err != nil {
+			log.Println(err)
+		}
+		return err
+	}
 
 	// TODO: also, have a way to automatically remove
 	// unverified accounts periodically.
@@ -276,34 +544,126 @@ func Signin(db DB, in *SigninIn, out *SigninOut) error {
 	return nil
 }
 
-func Login(db DB, in *LoginIn, out *LoginOut) error {
+func (a *Auth) Login(in *LoginIn, out *LoginOut) error {
+	// All failures look the same, and take about as long
+	// (bcrypt), so as not to tell whether an account exists
+	// or is locked.
+	invalid := fmt.Errorf("Invalid login or password")
+
 	var u User
 	u.Name = in.Login
 	u.Email = in.Login
-	if err := db.GetUser(&u); err != nil {
-		return err
+	if err := a.db.GetUser(&u); errors.Is(err, ErrNoUser) {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(in.Passwd))
+		return invalid
+	} else if err != nil {
+		return &intErr{err.Error()}
 	}
 
-	if !C.NoVerif && !u.Verified {
-		return fmt.Errorf("Email not verified")
+	// Don't even try the password: the lock would
+	// otherwise still leak successful guesses
+	now := time.Now().Unix()
+	if a.c.LockFails > 0 && u.LockUntil > now {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(in.Passwd))
+		return invalid
 	}
 
 	// constant time
 	err := bcrypt.CompareHashAndPassword([]byte(u.Passwd), []byte(in.Passwd))
-	if err == nil {
-		out.Token, err = NewToken(u.Id)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		// The accounting (DB writes, lock email) would otherwise
+		// make this slower than the unknown/locked cases.
+		a.background(func() error { return a.failedLogin(&u, now) })
+		return invalid
+	}
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+
+	// Only once the password is known to be right
+	if !a.c.NoVerif && !u.Verified {
+		return fmt.Errorf("Email not verified")
+	}
+
+	// Second factor (/2fa/login); failures aren't reset
+	// until it's provided.
+	t, err := a.db.GetTOTP(u.Id)
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+	if t != nil && t.Active {
+		out.SecondFactor = true
+		out.Challenge, err = a.mkChallenge(u.Id)
 		return err
 	}
 
-	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-		return fmt.Errorf("Invalid login or password")
+	return a.openLogin(&u, in.Refresh, in.UA, in.IP, out)
+}
+
+// Open a session for a successfully logged in user
+func (a *Auth) openLogin(u *User, refresh bool, ua, ip string, out *LoginOut) (err error) {
+	if u.Fails != 0 || u.LockUntil != 0 {
+		if err := a.db.SetLock(u.Id, 0, 0); err != nil {
+			return &intErr{err.Error()}
+		}
+	}
+
+	if refresh {
+		out.Token, out.Refresh, err = a.newRefreshSession(u.Id, ua, ip)
+		return err
+	}
+
+	out.Token, err = a.newSessionToken(u.Id, ua, ip)
+	return err
+}
+
+// Lock duration after n consecutive failed logins (n >= LockFails):
+// LockTimeout, doubled for each further failure, up to LockMaxTimeout.
+func (a *Auth) lockTimeout(n int) int64 {
+	d := a.c.LockTimeout
+	for i := a.c.LockFails; i < n && d < 1<<40; i++ {
+		d *= 2
+	}
+	if a.c.LockMaxTimeout > 0 && d > a.c.LockMaxTimeout {
+		d = a.c.LockMaxTimeout
+	}
+	return d
+}
+
+// Record a failed login for u, locking the account (and
+// notifying its owner) once there are too many of them.
+func (a *Auth) failedLogin(u *User, now int64) error {
+	if a.c.LockFails <= 0 {
+		return nil
+	}
+
+	// Incremented by the DB: concurrent failures all count
+	n, err := a.db.AddFail(u.Id)
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+	u.Fails = n
+
+	locked := u.Fails >= a.c.LockFails
+	if locked {
+		u.LockUntil = now+a.lockTimeout(u.Fails)
+		if err := a.db.LockUser(u.Id, u.LockUntil); err != nil {
+			return &intErr{err.Error()}
+		}
 	}
 
-	return &intErr{err.Error()}
+	// The lock holds anyway; don't tell the client about
+	// mailing issues.
+	if locked {
+		if err := a.sendLockEmail(u.Email, u.LockUntil-now); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
 }
 
-func Signout(db DB, in *SignoutIn, out *SignoutOut) error {
-	ok, uid, err := CheckToken(in.Token)
+func (a *Auth) Signout(in *SignoutIn, out *SignoutOut) error {
+	ok, uid, err := a.CheckToken(in.Token)
 	if err != nil {
 		return err
 	}
@@ -312,23 +672,30 @@ func Signout(db DB, in *SignoutIn, out *SignoutOut) error {
 	}
 
 	// TODO: maybe send a confirmation email
-	_, err = db.RmUser(uid)
+	if _, err = a.db.RmUser(uid); err != nil {
+		return err
+	}
 
+	return a.ClearUser(uid)
+}
+
+func (a *Auth) Chain(in *ChainIn, out *ChainOut) (err error) {
+	out.Token, err = a.ChainToken(in.Token)
 	return err
 }
 
-func Chain(db DB, in *ChainIn, out *ChainOut) (err error) {
-	out.Token, err = ChainToken(in.Token)
+func (a *Auth) Refresh(in *RefreshIn, out *RefreshOut) (err error) {
+	out.Token, out.Refresh, err = a.RefreshToken(in.Refresh)
 	return err
 }
 
-func Check(db DB, in *CheckIn, out *CheckOut) (err error) {
-	out.Match, _, err = CheckToken(in.Token)
+func (a *Auth) Check(in *CheckIn, out *CheckOut) (err error) {
+	out.Match, _, err = a.CheckToken(in.Token)
 	return err
 }
 
-func Logout(db DB, in *LogoutIn, out *LogoutOut) error {
-	ok, uid, err := CheckToken(in.Token)
+func (a *Auth) Logout(in *LogoutIn, out *LogoutOut) error {
+	ok, uid, err := a.CheckToken(in.Token)
 	if err != nil {
 		return err
 	}
@@ -336,74 +703,365 @@ func Logout(db DB, in *LogoutIn, out *LogoutOut) error {
 		return fmt.Errorf("Not connected!")
 	}
 
-	ClearUser(uid)
-	return nil
+	if in.All {
+		return a.ClearUser(uid)
+	}
 
+	return a.EndSession(in.Token)
 }
 
-func Edit(db DB, in *EditIn, out *EditOut) (err error) {
-	out.Token, err = ChainToken(in.Token)
+func (a *Auth) Edit(in *EditIn, out *EditOut) (err error) {
+	ok, uid, err := a.CheckToken(in.Token)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return fmt.Errorf("Not connected!")
+	}
 
-	// Don't chain & fetch data from db?
-	//
-	// Then if newpasswd exists is > 10 and
-	// so forth, update the password.
-	//
-	// Finally, as we'll had fetch User from
-	// db, we'll be able to determine whether
-	// email has changed, and if so, it should
-	// be valid as the JSON has checked it,
-	// and we just need to make sure it doesn't
-	// exists in database.
+	u := User{Id: uid}
+	if err := a.db.GetUser(&u); err != nil {
+		return err
+	}
+
+	if err := matchPasswd(&u, in.Passwd); err != nil {
+		return err
+	}
+
+	if in.Name != "" && in.Name != u.Name {
+		if err := checkName(in.Name); err != nil {
+			return err
+		}
+		u.Name = in.Name
+	}
+
+	if in.NewPasswd != "" {
+		if err := checkPasswd(in.NewPasswd); err != nil {
+			return err
+		}
+		if u.Passwd, err = hash(in.NewPasswd); err != nil {
+			return err
+		}
+	}
+
+	// The JSON decoder has already checked the email;
+	// the DB will make sure it's not already used.
+	email := in.Email.string != "" && in.Email.string != u.Email
+	if email {
+		u.Email    = in.Email.string
+		u.Verified = false
+	}
+
+	if err := a.db.EditUser(uid, &u); err != nil {
+		return err
+	}
+
+	// Tokens sent to a previous email would otherwise
+	// verify the new one.
+	if email {
+		if err := a.db.RmVerifs(uid); err != nil {
+			return &intErr{err.Error()}
+		}
+	}
+
+	if email && !a.c.NoVerif {
+		if err := a.startVerif(uid, u.Email); err != nil {
+			return err
+		}
+	}
+
+	// Short-lived tokens can't be chained: keep it, as
+	// the middleware does; the edition has been saved anyway.
+	out.Token, err = a.ChainToken(in.Token)
+	if errors.Is(err, errRefreshable) {
+		out.Token, err = in.Token, nil
+	}
+	return err
+}
+
+func (a *Auth) Verify(in *VerifyIn, out *VerifyOut) (err error) {
+	uid, err := a.tryVerifTok(in.Tok)
+	if err != nil {
+		return err
+	}
+
+	if err := a.db.VerifyUser(uid); err != nil {
+		return fmt.Errorf("Can't verify user '%d': %s", uid, err)
+	}
+
+	// XXX Alright, this is convenient, but maybe we'd want
+	// to think more about it; pretty sure I'd prefer to have
+	// a genuine JWT token in in.Token.
+	out.Token, err = a.NewToken(uid)
+	return err
+}
+
+func (a *Auth) Sessions(in *SessionsIn, out *SessionsOut) error {
+	s, err := a.tokenSession(in.Token)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("Not connected!")
+	}
+
+	ss, err := a.sessions.GetSessions(s.UId)
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+
+	now := time.Now().Unix()
+
+	out.Sessions = []SessionInfo{}
+	for _, x := range ss {
+		if x.EDate <= now {
+			continue
+		}
+		out.Sessions = append(out.Sessions, SessionInfo{
+			x.Id, x.CDate, x.LDate, x.UA, x.IP, x.Id == s.Id,
+		})
+	}
 
 	return nil
 }
 
-func Verify(db DB, in *VerifyIn, out *VerifyOut) (err error) {
-	if uid := tryVerifTok(in.Token); uid != -1 {
-		if err := db.VerifyUser(uid); err != nil {
-			return fmt.Errorf("Can't verify user '%d': %s", uid, err)
+func (a *Auth) RevokeSessions(in *RevokeSessionsIn, out *RevokeSessionsOut) error {
+	s, err := a.tokenSession(in.Token)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("Not connected!")
+	}
+
+	if !in.All && in.Id == "" {
+		return fmt.Errorf("Missing session id")
+	}
+
+	ss, err := a.sessions.GetSessions(s.UId)
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+
+	found := false
+	for _, x := range ss {
+		if (in.All && x.Id != s.Id) || (!in.All && x.Id == in.Id) {
+			found = true
+			if err := a.sessions.RmSession(s.UId, x.Id); err != nil {
+				return &intErr{err.Error()}
+			}
 		}
+	}
+
+	// Only the caller's sessions can be revoked
+	if !in.All && !found {
+		return fmt.Errorf("Unknown session")
+	}
+	return nil
+}
+
+// NOTE: to avoid leaking whether an account exists, this
+// always succeeds, and the email is sent in the background
+// (the time taken to send it would otherwise leak it).
+func (a *Auth) Forgot(in *ForgotIn, out *ForgotOut) error {
+	var u User
+	u.Name = in.Login
+	u.Email = in.Login
+	if err := a.db.GetUser(&u); err != nil {
+		return nil
+	}
+
+	a.background(func() error { return a.startReset(u.Id, u.Email) })
 
-		// XXX Alright, this is convenient, but maybe we'd want
-		// to think more about it; pretty sure I'd prefer to have
-		// a genuine JWT token in in.Token.
-		out.Token, err = NewToken(uid)
+	return nil
+}
+
+func (a *Auth) Reset(in *ResetIn, out *ResetOut) error {
+	if err := checkPasswd(in.Passwd); err != nil {
 		return err
 	}
-	return fmt.Errorf("Invalid token")
+
+	uid, err := tryTok(a.db.PopReset, in.Tok, a.c.ResetTimeout)
+	if err != nil {
+		return err
+	}
+
+	u := User{Id: uid}
+	if err := a.db.GetUser(&u); err != nil {
+		return err
+	}
+
+	if u.Passwd, err = hash(in.Passwd); err != nil {
+		return err
+	}
+
+	if err := a.db.EditUser(uid, &u); err != nil {
+		return err
+	}
+
+	// Whoever was connected (e.g. an attacker) isn't anymore.
+	return a.ClearUser(uid)
+}
+
+// An authentication service: a configuration, a DB,
+// and everything derived from them (keys, sessions, etc.).
+// Multiple services can coexist in a single process.
+type Auth struct {
+	c        Config
+	db       DB
+	mailer   Mailer
+	sessions SessionStore
+
+	// see ReloadKeys()
+	keysMu     sync.RWMutex
+	keys       *keySet
+
+	// parsed c.CookieSameSite
+	sameSite   http.SameSite
+
+	// parsed c.TrustedProxies, c.RateLimits
+	proxies    []*net.IPNet
+	limiters   map[string]*routeLimiter
+
+	// encrypts TOTP secrets (c.TOTPKey); nil if unconfigured
+	totp       cipher.AEAD
+
+	// see background()
+	bg         sync.WaitGroup
 }
 
-// For quick tests: curl -X POST -d '{"Name": "user" }' localhost:7070/signin
-// XXX: Why is the loaded conf shared (module-wise) but not the DB?
-func New(db DB) *http.ServeMux {
+// Optional NewAuth() parameters
+type Option func(*Auth)
+
+// Defaults to a Mailer built from the configuration
+// (nil is ignored).
+func WithMailer(m Mailer) Option {
+	return func(a *Auth) {
+		if m != nil {
+			a.mailer = m
+		}
+	}
+}
+
+// Defaults to the DB if it implements SessionStore (so that
+// sessions survive restarts), to a MemSessions otherwise.
+func WithSessionStore(s SessionStore) Option {
+	return func(a *Auth) {
+		a.sessions = s
+	}
+}
+
+func NewAuth(c *Config, db DB, opts ...Option) (*Auth, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+
+	a := &Auth{c: *c, db: db}
+
+	// already checked
+	a.sameSite, _ = a.c.sameSite()
+	a.proxies, _  = parseProxies(a.c.TrustedProxies)
+	a.totp, _     = a.c.totpAEAD()
+
+	a.limiters = newRouteLimiters(a.c.RateLimits)
+
+	a.mailer = a.c.mailer()
+
+	a.sessions = NewMemSessions()
+	if s, ok := db.(SessionStore); ok {
+		a.sessions = s
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	if err := a.setKeys(&a.c); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// For quick tests:
+//	curl -X POST -H 'Content-Type: application/json' \
+//		-d '{"name": "user", "email": "user@example.com", "passwd": "..."}' \
+//		localhost:7070/signin
+func (a *Auth) Mux() *http.ServeMux {
 	mux := http.NewServeMux()
 
+	// Rate limited, as configured
+	handle := func(path string, h http.HandlerFunc) {
+		mux.HandleFunc(path, a.limit(path, h))
+	}
+
 	// signin from an email/username/password
-	mux.HandleFunc("/signin", Wrap[DB, SigninIn, SigninOut](db, Signin))
+	handle("/signin", Wrap[*Auth, SigninIn, SigninOut](a, a, (*Auth).Signin))
 
-	mux.HandleFunc("/signout", Wrap[DB, SignoutIn, SignoutOut](db, Signout))
+	handle("/signout", Wrap[*Auth, SignoutIn, SignoutOut](a, a, (*Auth).Signout))
 
 
-	mux.HandleFunc("/login", Wrap[DB, LoginIn, LoginOut](db, Login))
+	handle("/login", Wrap[*Auth, LoginIn, LoginOut](a, a, (*Auth).Login))
 
 	// Check a token's validity/update it
-	mux.HandleFunc("/chain", Wrap[DB, ChainIn, ChainOut](db, Chain))
+	handle("/chain", Wrap[*Auth, ChainIn, ChainOut](a, a, (*Auth).Chain))
+
+	// Trade a refresh token for new tokens (see /login)
+	handle("/refresh", Wrap[*Auth, RefreshIn, RefreshOut](a, a, (*Auth).Refresh))
 
 	// Check a token's validity
-	mux.HandleFunc("/check", Wrap[DB, CheckIn, CheckOut](db, Check))
+	handle("/check", Wrap[*Auth, CheckIn, CheckOut](a, a, (*Auth).Check))
 
-	mux.HandleFunc("/logout", Wrap[DB, LogoutIn, LogoutOut](db, Logout))
+	handle("/logout", Wrap[*Auth, LogoutIn, LogoutOut](a, a, (*Auth).Logout))
 
 	// email ownership verification upon signin,
 	// followed by an automatic login.
-	mux.HandleFunc("/verify", Wrap[DB, VerifyIn, VerifyOut](db, Verify))
+	handle("/verify", Wrap[*Auth, VerifyIn, VerifyOut](a, a, (*Auth).Verify))
 
 	// Password/email edition
-	mux.HandleFunc("/edit", Wrap[DB, EditIn, EditOut](db, Edit))
+	handle("/edit", Wrap[*Auth, EditIn, EditOut](a, a, (*Auth).Edit))
+
+	// List/revoke the connected user's sessions
+	handle("/sessions", Wrap[*Auth, SessionsIn, SessionsOut](a, a, (*Auth).Sessions))
+	handle("/sessions/revoke", Wrap[*Auth, RevokeSessionsIn, RevokeSessionsOut](a, a, (*Auth).RevokeSessions))
+
+	// Password reset (opt-in): send a reset link by email,
+	// and use the token it contains to set a new password.
+	if a.c.ResetURL != "" {
+		handle("/forgot", Wrap[*Auth, ForgotIn, ForgotOut](a, a, (*Auth).Forgot))
+		handle("/reset", Wrap[*Auth, ResetIn, ResetOut](a, a, (*Auth).Reset))
+	}
+
+	// TOTP second factor: enrollment, and second half of
+	// a /login for enrolled users.
+	handle("/2fa/enroll", Wrap[*Auth, TOTPEnrollIn, TOTPEnrollOut](a, a, (*Auth).TOTPEnroll))
+	handle("/2fa/confirm", Wrap[*Auth, TOTPConfirmIn, TOTPConfirmOut](a, a, (*Auth).TOTPConfirm))
+	handle("/2fa/login", Wrap[*Auth, TOTPLoginIn, LoginOut](a, a, (*Auth).TOTPLogin))
+
+	// Remaining recovery codes; regeneration (password)
+	handle("/2fa/recovery", Wrap[*Auth, TOTPRecoveryIn, TOTPRecoveryOut](a, a, (*Auth).TOTPRecovery))
+	handle("/2fa/recovery/regen", Wrap[*Auth, TOTPRegenIn, TOTPRegenOut](a, a, (*Auth).TOTPRegen))
+
+	// For resource servers (form-encoded, client credentials)
+	handle("/introspect", a.serveIntrospect)
+	handle("/revoke", a.serveRevoke)
+
+	// Public keys, to verify tokens (GET)
+	handle("/jwks.json", a.serveJWKS)
+	handle("/.well-known/jwks.json", a.serveJWKS)
 
 	return mux
 }
+
+// Compatibility wrapper: build an Auth from the configuration
+// loaded by LoadConf().
+func New(db DB, opts ...Option) *http.ServeMux {
+	a, err := NewAuth(&C, db, opts...)
+
+	// LoadConf() has already checked the configuration
+	if err != nil {
+		panic(err)
+	}
+
+	return a.Mux()
+}
@@ -0,0 +1,34 @@
+// Generate a (dummy) key pair to sign tokens:
+//
+//	go run ./cmd/genkeys [-alg ES256|EdDSA|RS256|PS256] [-priv private.pem] [-pub public.pem]
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mbivert/auth"
+)
+
+func main() {
+	alg  := flag.String("alg", "ES256", "signing algorithm (ES256, EdDSA, RS256, PS256)")
+	priv := flag.String("priv", "private.pem", "private key output file")
+	pub  := flag.String("pub", "public.pem", "public key output file")
+	flag.Parse()
+
+	xs, ys, err := auth.GenKey(*alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Generating private key:", *priv)
+	if err := os.WriteFile(*priv, xs, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Generating public key: ", *pub)
+	if err := os.WriteFile(*pub, ys, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -5,80 +5,214 @@ package auth
 import (
 	"encoding/json"
 	"io/ioutil"
-	"crypto/ecdsa"
-	jwt "github.com/golang-jwt/jwt/v5"
 	"fmt"
+	"net/http"
+	"strings"
 )
 
 type Config struct {
+	// Signing algorithm: HS256 (HMAC), ES256, EdDSA (Ed25519),
+	// RS256 or PS256 (PrivateKey). Defaults to ES256 if a
+	// PrivateKey is set, to HS256 otherwise.
+	Alg        string
+
 	HMAC       string
 	PublicKey  string
 	PrivateKey string
 
-	// TODO: defined but not implemented yet.
+	// Keys still accepted to verify tokens, but no longer used
+	// to sign them (rotations): old HMAC secrets, PEM files
+	// (public or private keys), and a directory of *.pem files.
+	OldHMACs   []string
+	VerifyKeys []string
+	KeyDir     string
+
+	// How to send verification emails
 	NoVerif    bool
 	SMTPServer string
 	SMTPPort   string
 	AuthEmail  string
 	AuthPasswd string
 
+	// If set, emails are written to this directory
+	// instead of being sent (dev)
+	MailDir    string
+
+	// Frontend page receiving the verification token
+	// as a "token" URL parameter
+	VerifURL   string
+
+	// Verification tokens lifetime
+	VerifTimeout int64
+
+	// Same as VerifURL/VerifTimeout, for password resets;
+	// /forgot and /reset are disabled without a ResetURL.
+	ResetURL     string
+	ResetTimeout int64
+
 	Timeout    int64
 	LenUniq    int
+
+	// Sessions opened with a refresh token (opt-in, /login):
+	// lifetime of their tokens, and of the refresh tokens
+	// (0 disables refresh tokens).
+	AccessTimeout  int64
+	RefreshTimeout int64
+
+	// Tokens' "iss"/"aud" claims; checked when set
+	Issuer     string
+	Audience   string
+
+	// Clock skew tolerance (seconds) on exp/iat/nbf
+	Leeway     int64
+
+	// Accept tokens in the old (uid, uniq, date) format;
+	// for migrations only.
+	LegacyTokens bool
+
+	// Should RequireAuth()/OptionalAuth() chain valid tokens?
+	AuthChain  bool
+
+	// Where to look for input tokens, by order of precedence:
+	// "cookie" and/or "bearer" (Authorization header).
+	// Defaults to cookie first.
+	TokenSources []string
+
+	// Never send tokens as cookies, only in the JSON output
+	NoCookie   bool
+	// Token cookie attributes; CookieName defaults to "token",
+	// and CookiePath to "/". Names can be prefixed by "__Host-"
+	// or "__Secure-" (constraints are checked).
+	CookieName     string
+	CookiePath     string
+	CookieDomain   string
+	CookieSecure   bool
+
+	// "", "lax", "strict" or "none" (requires CookieSecure)
+	CookieSameSite string
+
+	// JS-readable cookie set to "1"/"0" when logged in/out;
+	// ConnectedName defaults to "connected".
+	ConnectedName  string
+	NoConnected    bool
+	// If set, requests with an Origin/Referer header must come
+	// from one of those (e.g. "https://example.com")
+	Origins        []string
+
+	// Double-submit CSRF token: a JS-readable cookie (CSRFName,
+	// defaults to "csrf") to be sent back in an X-CSRF-Token header
+	// with cookie-authenticated requests.
+	CSRF           bool
+	CSRFName       string
+
+	// Clients (e.g. resource servers) allowed to use /introspect
+	// and /revoke: client id -> secret
+	Clients        map[string]string
+	// Rate limits, by route (e.g. "/login")
+	RateLimits     map[string]RouteLimits
+
+	// Proxies (IPs or CIDRs) whose X-Forwarded-For are trusted
+	// to identify clients
+	TrustedProxies []string
+
+	// /signin succeeds for already registered emails (their
+	// owner is notified instead), so that it doesn't tell which
+	// emails are registered; requires email verification.
+	//
+	// NOTE: usernames are still reported as taken.
+	QuietSignin    bool
+
+	// Base64-encoded AES key (16, 24 or 32 bytes) encrypting
+	// TOTP secrets; 2FA enrollment is unavailable if unset.
+	TOTPKey          string
+
+	// Issuer shown by authenticator apps; defaults to "auth"
+	TOTPIssuer       string
+
+	// Lifetime of /login's second factor challenges
+	ChallengeTimeout int64
+
+	// Lock accounts for LockTimeout seconds after LockFails
+	// consecutive failed logins (0 disables); each further
+	// failure doubles the lock, up to LockMaxTimeout (if set).
+	LockFails      int
+	LockTimeout    int64
+	LockMaxTimeout int64
 }
 
+// Configuration loaded by LoadConf(), used by New(); prefer
+// ReadConf() and NewAuth().
 var C Config
-var publicKey  *ecdsa.PublicKey
-var privateKey *ecdsa.PrivateKey
 
-func LoadKeys() error {
-	pub, err := ioutil.ReadFile(C.PublicKey)
-	if err != nil {
-		return fmt.Errorf("Cannot load public key: %s", err)
+func (c *Config) check() error {
+	if c.HMAC == "" && c.PrivateKey == "" {
+		return fmt.Errorf("At least a HMAC or a PrivateKey must be specified")
 	}
 
-	priv, err := ioutil.ReadFile(C.PrivateKey)
-	if err != nil {
-		return fmt.Errorf("Cannot load private key: %s", err)
+	if _, err := c.loadKeySet(); err != nil {
+		return err
 	}
 
-	// For clarity (but also used to check which one to use)
-	C.HMAC = ""
-
-	privateKey, err = jwt.ParseECPrivateKeyFromPEM(priv)
-	if err != nil {
-		return fmt.Errorf("Private key (.pem) parsing error: %s", err)
+	if !c.NoVerif && c.VerifURL == "" {
+		return fmt.Errorf("VerifURL must be specified when verifying emails")
 	}
 
-	publicKey, err = jwt.ParseECPublicKeyFromPEM(pub)
-	if err != nil {
-		return fmt.Errorf("Public key parsing error: %s", err)
+	if !c.NoVerif && c.VerifTimeout == 0 {
+		return fmt.Errorf("VerifTimeout unconfigured ?")
 	}
 
-	return nil
-}
+	// Password resets are opt-in
+	if c.ResetURL != "" && c.ResetTimeout == 0 {
+		return fmt.Errorf("ResetTimeout unconfigured ?")
+	}
 
-func LoadConf(fn string) error {
-	x, err := ioutil.ReadFile(fn)
-	if err != nil {
-		return fmt.Errorf("Cannot read configuration file: %s", err)
+	if len(c.TokenSources) == 0 {
+		c.TokenSources = []string{"cookie", "bearer"}
+	}
+	for _, src := range c.TokenSources {
+		if src != "cookie" && src != "bearer" {
+			return fmt.Errorf("Unknown token source: '%s'", src)
+		}
 	}
 
-	if err := json.Unmarshal(x, &C); err != nil {
-		return fmt.Errorf("Error while parsing configuration file: %s", err)
+	if c.RefreshTimeout != 0 && c.AccessTimeout == 0 {
+		return fmt.Errorf("AccessTimeout unconfigured ?")
 	}
 
-	if C.PrivateKey != "" {
-		if err := LoadKeys(); err != nil {
-			return err
+	for id, secret := range c.Clients {
+		if id == "" || secret == "" {
+			return fmt.Errorf("Clients must have an id and a secret")
 		}
 	}
 
-	if C.HMAC == "" && C.PrivateKey == "" {
-		return fmt.Errorf("At least a HMAC or a PrivateKey must be specified")
+	if c.QuietSignin && c.NoVerif {
+		return fmt.Errorf("QuietSignin requires email verification")
+	}
+
+	if _, err := c.totpAEAD(); err != nil {
+		return err
+	}
+	if c.TOTPIssuer == "" {
+		c.TOTPIssuer = "auth"
+	}
+	if c.TOTPKey != "" && c.ChallengeTimeout == 0 {
+		return fmt.Errorf("ChallengeTimeout unconfigured ?")
+	}
+
+	if c.LockFails > 0 && c.LockTimeout <= 0 {
+		return fmt.Errorf("LockTimeout unconfigured ?")
+	}
+
+	if _, err := parseProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+
+	if err := c.checkCookies(); err != nil {
+		return err
 	}
 
 	// XXX we may even want to not allow below a certain threshold here
-	if C.LenUniq == 0 {
+	if c.LenUniq == 0 {
 		return fmt.Errorf("LenUniq unconfigured ?")
 	}
 
@@ -86,3 +220,82 @@ func LoadConf(fn string) error {
 	//	Wrong configuration => undefined behavior.
 	return nil
 }
+
+func ReadConf(fn string) (*Config, error) {
+	x, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read configuration file: %s", err)
+	}
+
+	var c Config
+	if err := json.Unmarshal(x, &c); err != nil {
+		return nil, fmt.Errorf("Error while parsing configuration file: %s", err)
+	}
+
+	return &c, c.check()
+}
+
+// Compatibility: ReadConf() into C
+func LoadConf(fn string) error {
+	c, err := ReadConf(fn)
+	if err != nil {
+		return err
+	}
+	C = *c
+	return nil
+}
+
+func (c *Config) sameSite() (http.SameSite, error) {
+	switch strings.ToLower(c.CookieSameSite) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("Unknown CookieSameSite: '%s'", c.CookieSameSite)
+}
+
+// Set cookie defaults, and ensure cookies would be
+// accepted by browsers.
+func (c *Config) checkCookies() error {
+	if c.CookieName == "" {
+		c.CookieName = CookieName
+	}
+	if c.ConnectedName == "" {
+		c.ConnectedName = ConnectedName
+	}
+	if c.CSRFName == "" {
+		c.CSRFName = CSRFName
+	}
+	if c.CookiePath == "" {
+		c.CookiePath = "/"
+	}
+
+	ss, err := c.sameSite()
+	if err != nil {
+		return err
+	}
+	if ss == http.SameSiteNoneMode && !c.CookieSecure {
+		return fmt.Errorf("CookieSameSite 'none' requires CookieSecure")
+	}
+
+	// https://datatracker.ietf.org/doc/html/draft-ietf-httpbis-rfc6265bis#name-cookie-name-prefixes
+	for _, n := range []string{c.CookieName, c.ConnectedName, c.CSRFName} {
+		if strings.HasPrefix(n, "__Secure-") && !c.CookieSecure {
+			return fmt.Errorf("'%s' requires CookieSecure", n)
+		}
+		if !strings.HasPrefix(n, "__Host-") {
+			continue
+		}
+		if !c.CookieSecure || c.CookiePath != "/" || c.CookieDomain != "" {
+			return fmt.Errorf("'%s' requires CookieSecure, "+
+				"CookiePath \"/\" and no CookieDomain", n)
+		}
+	}
+
+	return nil
+}
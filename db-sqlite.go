@@ -1,7 +1,8 @@
 package auth
 
 /*
- * Implements auth.DB (../../types.go:/type DB interface).
+ * Implements auth.DB (../../types.go:/type DB interface),
+ * and auth.SessionStore.
  */
 
 import (
@@ -43,10 +44,89 @@ func (db *SQLiteDB) AddTable() error {
 			Email       TEXT        UNIQUE,
 			Passwd      TEXT,
 			Verified    INTEGER,
+			CDate       INTEGER,
+			Fails       INTEGER     DEFAULT 0,
+			LockUntil   INTEGER     DEFAULT 0
+		);
+		CREATE TABLE IF NOT EXISTS
+		Verif (
+			Token       TEXT        PRIMARY KEY NOT NULL,
+			UId         INTEGER     NOT NULL,
 			CDate       INTEGER
-		)
+		);
+		CREATE TABLE IF NOT EXISTS
+		Reset (
+			Token       TEXT        PRIMARY KEY NOT NULL,
+			UId         INTEGER     NOT NULL,
+			CDate       INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS
+		Challenge (
+			Token       TEXT        PRIMARY KEY NOT NULL,
+			UId         INTEGER     NOT NULL,
+			CDate       INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS
+		TOTP (
+			UId         INTEGER     PRIMARY KEY NOT NULL,
+			Secret      TEXT,
+			Active      INTEGER,
+			Last        INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS
+		Recovery (
+			Hash        TEXT        PRIMARY KEY NOT NULL,
+			UId         INTEGER     NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS
+		Session (
+			UId         INTEGER     NOT NULL,
+			Id          TEXT        NOT NULL,
+			Uniq        TEXT,
+			EDate       INTEGER,
+			CDate       INTEGER,
+			LDate       INTEGER,
+			UA          TEXT,
+			IP          TEXT,
+			PRIMARY KEY (UId, Id)
+		);
+		CREATE TABLE IF NOT EXISTS
+		Refresh (
+			Hash        TEXT        PRIMARY KEY NOT NULL,
+			UId         INTEGER     NOT NULL,
+			SId         TEXT        NOT NULL,
+			CDate       INTEGER,
+			Used        INTEGER
+		);
 	`)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the tables were first created
+	return db.addColumns("User", map[string]string{
+		"Fails"     : "INTEGER DEFAULT 0",
+		"LockUntil" : "INTEGER DEFAULT 0",
+	})
+}
+
+// NOTE: table/columns are never user-provided; caller locks.
+func (db *SQLiteDB) addColumns(table string, cols map[string]string) error {
+	for col, def := range cols {
+		n := 0
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info($1)
+			WHERE name = $2`, table, col).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE `+table+` ADD COLUMN `+col+` `+def); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // XXX/TODO: we're probably leaking email address bytes
@@ -75,11 +155,16 @@ func (db *SQLiteDB) AddUser(u *User) error {
 		err = fmt.Errorf("Username already used")
 	}
 */
+	return uniqErr(err)
+}
+
+// Improve UNIQUE constraints error messages on the User table.
+func uniqErr(err error) error {
 	if err != nil && err.Error() == "sqlite3: constraint failed: UNIQUE constraint failed: User.Email" {
-		err = fmt.Errorf("Email already used")
+		err = ErrEmailUsed
 	}
 	if err != nil && err.Error() == "sqlite3: constraint failed: UNIQUE constraint failed: User.Name" {
-		err = fmt.Errorf("Username already used")
+		err = ErrNameUsed
 	}
 
 	return err
@@ -125,11 +210,12 @@ func (db *SQLiteDB) GetUser(u *User) error {
 
 	// TODO: clarify exec vs. query (is there a prepare here?)
 	err := db.QueryRow(`SELECT
-			Id, Name, Email, Passwd, Verified, CDate
+			Id, Name, Email, Passwd, Verified, CDate, Fails, LockUntil
 		FROM User WHERE
-			Name  = $1
-		OR  Email = $2
-	`, u.Name, u.Email).Scan(&u.Id, &u.Name, &u.Email, &u.Passwd, &verified, &u.CDate)
+			($1 > 0 AND Id = $1)
+		OR  ($1 = 0 AND (Name = $2 OR Email = $3))
+	`, u.Id, u.Name, u.Email).Scan(&u.Id, &u.Name, &u.Email, &u.Passwd,
+		&verified, &u.CDate, &u.Fails, &u.LockUntil)
 
 	if err == nil && verified > 0 {
 		u.Verified = true
@@ -137,7 +223,7 @@ func (db *SQLiteDB) GetUser(u *User) error {
 
 	// Improve error message
 	if errors.Is(err, sql.ErrNoRows) {
-		err = fmt.Errorf("Invalid username or email")
+		err = ErrNoUser
 	}
 
 	return err
@@ -154,9 +240,452 @@ func (db *SQLiteDB) RmUser(uid UserId) (email string, err error) {
 		err = fmt.Errorf("Invalid uid")
 	}
 
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM Verif WHERE UId = $1`, uid)
+	}
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM Reset WHERE UId = $1`, uid)
+	}
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM Challenge WHERE UId = $1`, uid)
+	}
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM TOTP WHERE UId = $1`, uid)
+	}
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM Recovery WHERE UId = $1`, uid)
+	}
+
 	return email, err
 }
 
-func (db *SQLiteDB) EditUser() error {
-	return fmt.Errorf("TODO")
+func (db *SQLiteDB) EditUser(uid UserId, u *User) error {
+	db.Lock()
+	defer db.Unlock()
+
+	x := 0
+
+	// NOTE: same RETURNING trick as in VerifyUser()
+	err := db.QueryRow(`
+		UPDATE
+			User
+		SET
+			Name     = $1,
+			Email    = $2,
+			Passwd   = $3,
+			Verified = $4
+		WHERE
+			Id  = $5
+		RETURNING
+			1
+	`, u.Name, u.Email, u.Passwd, u.Verified, uid).Scan(&x)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("Invalid uid")
+	}
+
+	return uniqErr(err)
+}
+
+func (db *SQLiteDB) SetLock(uid UserId, fails int, until int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	x := 0
+
+	// NOTE: same RETURNING trick as in VerifyUser()
+	err := db.QueryRow(`
+		UPDATE
+			User
+		SET
+			Fails     = $1,
+			LockUntil = $2
+		WHERE
+			Id  = $3
+		RETURNING
+			1
+	`, fails, until, uid).Scan(&x)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("Invalid uid")
+	}
+
+	return err
+}
+
+func (db *SQLiteDB) AddFail(uid UserId) (int, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	n := 0
+
+	err := db.QueryRow(`
+		UPDATE
+			User
+		SET
+			Fails = Fails + 1
+		WHERE
+			Id  = $1
+		RETURNING
+			Fails
+	`, uid).Scan(&n)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("Invalid uid")
+	}
+
+	return n, err
+}
+
+func (db *SQLiteDB) LockUser(uid UserId, until int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	x := 0
+
+	// NOTE: same RETURNING trick as in VerifyUser()
+	err := db.QueryRow(`
+		UPDATE
+			User
+		SET
+			LockUntil = MAX(LockUntil, $1)
+		WHERE
+			Id  = $2
+		RETURNING
+			1
+	`, until, uid).Scan(&x)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("Invalid uid")
+	}
+
+	return err
+}
+
+// NOTE: table is never user-provided.
+func (db *SQLiteDB) addTok(table, tok string, uid UserId, cdate int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`INSERT INTO
+		`+table+` (Token, UId, CDate)
+		VALUES($1, $2, $3)`, tok, uid, cdate)
+
+	return err
+}
+
+func (db *SQLiteDB) popTok(table, tok string) (uid UserId, cdate int64, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	err = db.QueryRow(`DELETE FROM `+table+` WHERE Token = $1
+		RETURNING UId, CDate`, tok).Scan(&uid, &cdate)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("Invalid token")
+	}
+
+	return uid, cdate, err
+}
+
+func (db *SQLiteDB) AddVerif(tok string, uid UserId, cdate int64) error {
+	return db.addTok("Verif", tok, uid, cdate)
+}
+
+func (db *SQLiteDB) PopVerif(tok string) (UserId, int64, error) {
+	return db.popTok("Verif", tok)
+}
+
+func (db *SQLiteDB) RmVerifs(uid UserId) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`DELETE FROM Verif WHERE UId = $1`, uid)
+	return err
+}
+
+func (db *SQLiteDB) AddReset(tok string, uid UserId, cdate int64) error {
+	return db.addTok("Reset", tok, uid, cdate)
+}
+
+func (db *SQLiteDB) PopReset(tok string) (UserId, int64, error) {
+	return db.popTok("Reset", tok)
+}
+
+func (db *SQLiteDB) AddChallenge(tok string, uid UserId, cdate int64) error {
+	return db.addTok("Challenge", tok, uid, cdate)
+}
+
+func (db *SQLiteDB) PopChallenge(tok string) (UserId, int64, error) {
+	return db.popTok("Challenge", tok)
+}
+
+func (db *SQLiteDB) SetTOTP(t *TOTP) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`INSERT INTO
+		TOTP (UId, Secret, Active, Last)
+		VALUES($1, $2, $3, $4)
+		ON CONFLICT (UId) DO UPDATE SET
+			Secret = excluded.Secret,
+			Active = excluded.Active,
+			Last   = excluded.Last
+	`, t.UId, t.Secret, t.Active, t.Last)
+
+	return err
+}
+
+func (db *SQLiteDB) GetTOTP(uid UserId) (*TOTP, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	t := TOTP{UId: uid}
+	active := 0
+
+	err := db.QueryRow(`SELECT
+			Secret, Active, Last
+		FROM TOTP WHERE
+			UId = $1
+	`, uid).Scan(&t.Secret, &active, &t.Last)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.Active = active > 0
+	return &t, nil
+}
+
+func (db *SQLiteDB) UseTOTP(uid UserId, step int64) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	x := 0
+
+	// NOTE: same RETURNING trick as in VerifyUser()
+	err := db.QueryRow(`
+		UPDATE
+			TOTP
+		SET
+			Last = $1
+		WHERE
+			UId  = $2
+		AND Last < $1
+		RETURNING
+			1
+	`, step, uid).Scan(&x)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *SQLiteDB) SetRecovery(uid UserId, hashes []string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM Recovery WHERE UId = $1`, uid); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		_, err := tx.Exec(`INSERT INTO
+			Recovery (Hash, UId)
+			VALUES($1, $2)`, h, uid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) UseRecovery(uid UserId, hash string) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	x := 0
+
+	err := db.QueryRow(`DELETE FROM Recovery WHERE
+			UId  = $1
+		AND Hash = $2
+		RETURNING 1`, uid, hash).Scan(&x)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *SQLiteDB) CountRecovery(uid UserId) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM Recovery
+		WHERE UId = $1`, uid).Scan(&n)
+
+	return n, err
+}
+
+func (db *SQLiteDB) SetSession(s *Session) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`INSERT INTO
+		Session (UId, Id, Uniq, EDate, CDate, LDate, UA, IP)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (UId, Id) DO UPDATE SET
+			Uniq  = excluded.Uniq,
+			EDate = excluded.EDate,
+			CDate = excluded.CDate,
+			LDate = excluded.LDate,
+			UA    = excluded.UA,
+			IP    = excluded.IP
+	`, s.UId, s.Id, s.Uniq, s.EDate, s.CDate, s.LDate, s.UA, s.IP)
+
+	return err
+}
+
+func (db *SQLiteDB) GetSession(uid UserId, sid string) (*Session, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	s := Session{UId: uid, Id: sid}
+
+	err := db.QueryRow(`SELECT
+			Uniq, EDate, CDate, LDate, UA, IP
+		FROM Session WHERE
+			UId = $1
+		AND Id  = $2
+	`, uid, sid).Scan(&s.Uniq, &s.EDate, &s.CDate, &s.LDate, &s.UA, &s.IP)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (db *SQLiteDB) GetSessions(uid UserId) ([]Session, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	rows, err := db.Query(`SELECT
+			Id, Uniq, EDate, CDate, LDate, UA, IP
+		FROM Session WHERE
+			UId = $1
+		ORDER BY CDate, rowid
+	`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ss := []Session{}
+	for rows.Next() {
+		s := Session{UId: uid}
+		err := rows.Scan(&s.Id, &s.Uniq, &s.EDate, &s.CDate, &s.LDate, &s.UA, &s.IP)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+
+	return ss, rows.Err()
+}
+
+func (db *SQLiteDB) RmSession(uid UserId, sid string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`DELETE FROM Session WHERE UId = $1 AND Id = $2`, uid, sid)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM Refresh WHERE UId = $1 AND SId = $2`, uid, sid)
+	return err
+}
+
+func (db *SQLiteDB) RmSessions(uid UserId) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`DELETE FROM Session WHERE UId = $1`, uid)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM Refresh WHERE UId = $1`, uid)
+	return err
+}
+
+func (db *SQLiteDB) ExpireSessions(date int64) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`DELETE FROM Session WHERE EDate <= $1`, date)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`DELETE FROM Refresh WHERE NOT EXISTS (
+			SELECT 1 FROM Session WHERE
+				Session.UId = Refresh.UId
+			AND Session.Id  = Refresh.SId
+		)`)
+	return err
+}
+
+func (db *SQLiteDB) AddRefresh(r *Refresh) error {
+	db.Lock()
+	defer db.Unlock()
+
+	_, err := db.Exec(`INSERT INTO
+		Refresh (Hash, UId, SId, CDate, Used)
+		VALUES($1, $2, $3, $4, $5)
+	`, r.Hash, r.UId, r.SId, r.CDate, r.Used)
+
+	return err
+}
+
+// NOTE: atomic, as all accesses are serialized by db.Mutex
+func (db *SQLiteDB) UseRefresh(hash string) (*Refresh, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	r := Refresh{Hash: hash}
+
+	err := db.QueryRow(`SELECT
+			UId, SId, CDate, Used
+		FROM Refresh WHERE
+			Hash = $1
+	`, hash).Scan(&r.UId, &r.SId, &r.CDate, &r.Used)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`UPDATE Refresh SET Used = 1 WHERE Hash = $1`, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
 }
@@ -10,6 +10,7 @@ import (
 	"os"
 	"fmt"
 	"log"
+	"sync"
 	"github.com/mbivert/ftests"
 )
 
@@ -199,6 +200,18 @@ func TestGetUser(t *testing.T) {
 			[]any{email},
 			[]any{&u, nil},
 		},
+		{
+			"Retrieving user by id",
+			func(uid UserId) (*User, error) {
+				u := User{Id: uid}
+				if err := db.GetUser(&u); err != nil {
+					return nil, err
+				}
+				return &u, nil
+			},
+			[]any{UserId(1)},
+			[]any{&u, nil},
+		},
 		{
 			"Retrieving inexisting user",
 			getUser,
@@ -270,3 +283,773 @@ func TestRmUser(t *testing.T) {
 		},
 	})
 }
+
+func TestEditUser(t *testing.T) {
+	initsqlitetest()
+
+	now := time.Now().Unix()
+
+	// nil user pointer
+	var x *User
+
+	u := User{
+		Id       : 0,
+		Name     : "t",
+		Email    : "t",
+		Passwd   : "t",
+		Verified : true,
+		CDate    : now,
+	}
+
+	v := User{
+		Id       : 0,
+		Name     : "t0",
+		Email    : "t0",
+		Passwd   : "t0",
+		Verified : false,
+		CDate    : now,
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Registering a first user",
+			db.AddUser,
+			[]any{&u},
+			[]any{nil},
+		},
+		{
+			"Registering a second user",
+			db.AddUser,
+			[]any{&v},
+			[]any{nil},
+		},
+		{
+			"Editing everything",
+			db.EditUser,
+			[]any{UserId(1), &User{
+				Name     : "t1",
+				Email    : "t1",
+				Passwd   : "t1",
+				Verified : false,
+			}},
+			[]any{nil},
+		},
+		{
+			"User has indeed been edited",
+			getUser,
+			[]any{"t1"},
+			[]any{&User{
+				Id       : 1,
+				Name     : "t1",
+				Email    : "t1",
+				Passwd   : "t1",
+				Verified : false,
+				CDate    : now,
+			}, nil},
+		},
+		{
+			"Old name is gone",
+			getUser,
+			[]any{"t"},
+			[]any{x, fmt.Errorf(
+				"Invalid username or email",
+			)},
+		},
+		{
+			"Can't steal someone else's username",
+			db.EditUser,
+			[]any{UserId(1), &User{
+				Name     : "t0",
+				Email    : "t1",
+				Passwd   : "t1",
+			}},
+			[]any{fmt.Errorf("Username already used")},
+		},
+		{
+			"Can't steal someone else's email",
+			db.EditUser,
+			[]any{UserId(1), &User{
+				Name     : "t1",
+				Email    : "t0",
+				Passwd   : "t1",
+			}},
+			[]any{fmt.Errorf("Email already used")},
+		},
+		{
+			"Can't edit an inexisting user",
+			db.EditUser,
+			[]any{UserId(42), &User{
+				Name     : "t42",
+				Email    : "t42",
+				Passwd   : "t42",
+			}},
+			[]any{fmt.Errorf("Invalid uid")},
+		},
+	})
+}
+
+func TestSetLock(t *testing.T) {
+	initsqlitetest()
+
+	now := time.Now().Unix()
+
+	u := User{
+		Name     : "t",
+		Email    : "t",
+		Passwd   : "t",
+		CDate    : now,
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Registering a user",
+			db.AddUser,
+			[]any{&u},
+			[]any{nil},
+		},
+		{
+			"Not locked by default",
+			getUser,
+			[]any{"t"},
+			[]any{&User{
+				Id       : 1,
+				Name     : "t",
+				Email    : "t",
+				Passwd   : "t",
+				CDate    : now,
+			}, nil},
+		},
+		{
+			"Locking",
+			db.SetLock,
+			[]any{UserId(1), 3, now+60},
+			[]any{nil},
+		},
+		{
+			"Lock state is stored",
+			getUser,
+			[]any{"t"},
+			[]any{&User{
+				Id        : 1,
+				Name      : "t",
+				Email     : "t",
+				Passwd    : "t",
+				CDate     : now,
+				Fails     : 3,
+				LockUntil : now+60,
+			}, nil},
+		},
+		{
+			"Editing an user keeps its lock state",
+			func() (int, error) {
+				if err := db.EditUser(UserId(1), &User{
+					Name     : "t",
+					Email    : "t",
+					Passwd   : "t1",
+				}); err != nil {
+					return 0, err
+				}
+				x, err := getUser("t")
+				if err != nil {
+					return 0, err
+				}
+				return x.Fails, nil
+			},
+			[]any{},
+			[]any{3, nil},
+		},
+		{
+			"Can't lock an inexisting user",
+			db.SetLock,
+			[]any{UserId(42), 1, int64(0)},
+			[]any{fmt.Errorf("Invalid uid")},
+		},
+		{
+			"Recording a failure",
+			db.AddFail,
+			[]any{UserId(1)},
+			[]any{4, nil},
+		},
+		{
+			"Concurrent failures all count",
+			func() (int, error) {
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						db.AddFail(UserId(1))
+					}()
+				}
+				wg.Wait()
+				x, err := getUser("t")
+				if err != nil {
+					return 0, err
+				}
+				return x.Fails, nil
+			},
+			[]any{},
+			[]any{14, nil},
+		},
+		{
+			"Can't record a failure for an inexisting user",
+			db.AddFail,
+			[]any{UserId(42)},
+			[]any{0, fmt.Errorf("Invalid uid")},
+		},
+		{
+			"Extending the lock",
+			func() (int64, error) {
+				if err := db.LockUser(UserId(1), now+120); err != nil {
+					return 0, err
+				}
+				x, err := getUser("t")
+				if err != nil {
+					return 0, err
+				}
+				return x.LockUntil, nil
+			},
+			[]any{},
+			[]any{now+120, nil},
+		},
+		{
+			"A later lock is kept",
+			func() (int64, error) {
+				if err := db.LockUser(UserId(1), now+30); err != nil {
+					return 0, err
+				}
+				x, err := getUser("t")
+				if err != nil {
+					return 0, err
+				}
+				return x.LockUntil, nil
+			},
+			[]any{},
+			[]any{now+120, nil},
+		},
+		{
+			"Can't lock an inexisting user (LockUser)",
+			db.LockUser,
+			[]any{UserId(42), now},
+			[]any{fmt.Errorf("Invalid uid")},
+		},
+	})
+}
+
+// Tables created before the Fails/LockUntil columns
+func TestAddColumns(t *testing.T) {
+	initsqlitetest()
+	db.Close()
+
+	dbfn := "./db_test.sqlite"
+	if err := os.RemoveAll(dbfn); err != nil {
+		log.Fatal(err)
+	}
+
+	old, err := NewSQLite(dbfn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, q := range []string{
+		`DROP TABLE User`,
+		`CREATE TABLE User (
+			Id                      INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+			Name        TEXT        UNIQUE,
+			Email       TEXT        UNIQUE,
+			Passwd      TEXT,
+			Verified    INTEGER,
+			CDate       INTEGER
+		)`,
+		`INSERT INTO User (Name, Email, Passwd, Verified, CDate)
+			VALUES('t', 't', 't', 0, 1)`,
+	} {
+		if _, err := old.Exec(q); err != nil {
+			log.Fatal(err)
+		}
+	}
+	old.Close()
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Reopening adds the columns",
+			func() (*User, error) {
+				db, err = NewSQLite(dbfn)
+				if err != nil {
+					return nil, err
+				}
+				return getUser("t")
+			},
+			[]any{},
+			[]any{&User{
+				Id       : 1,
+				Name     : "t",
+				Email    : "t",
+				Passwd   : "t",
+				CDate    : 1,
+			}, nil},
+		},
+		{
+			"Reopening again is a no-op",
+			func() error {
+				db.Close()
+				db, err = NewSQLite(dbfn)
+				return err
+			},
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Columns are usable",
+			// NOTE: db has been replaced since the table was built
+			func() error { return db.SetLock(UserId(1), 1, 2) },
+			[]any{},
+			[]any{nil},
+		},
+	})
+}
+
+func TestVerif(t *testing.T) {
+	initsqlitetest()
+
+	now := time.Now().Unix()
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Adding a token",
+			db.AddVerif,
+			[]any{"tok", UserId(1), now},
+			[]any{nil},
+		},
+		{
+			"Tokens are unique",
+			func() bool { return db.AddVerif("tok", UserId(2), now) != nil },
+			[]any{},
+			[]any{true},
+		},
+		{
+			"Retrieving a token",
+			db.PopVerif,
+			[]any{"tok"},
+			[]any{UserId(1), now, nil},
+		},
+		{
+			"Tokens can only be retrieved once",
+			db.PopVerif,
+			[]any{"tok"},
+			[]any{UserId(0), int64(0), fmt.Errorf("Invalid token")},
+		},
+		{
+			"Adding two tokens",
+			func() error {
+				if err := db.AddVerif("tok1", UserId(1), now); err != nil {
+					return err
+				}
+				return db.AddVerif("tok2", UserId(2), now)
+			},
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Dropping the tokens of an user",
+			db.RmVerifs,
+			[]any{UserId(1)},
+			[]any{nil},
+		},
+		{
+			"Token is gone",
+			db.PopVerif,
+			[]any{"tok1"},
+			[]any{UserId(0), int64(0), fmt.Errorf("Invalid token")},
+		},
+		{
+			"Other users' tokens are kept",
+			db.PopVerif,
+			[]any{"tok2"},
+			[]any{UserId(2), now, nil},
+		},
+	})
+}
+
+// NOTE: also used to test MemSessions
+func testSessionStore(t *testing.T, s SessionStore) {
+	// nil session pointer
+	var x *Session
+
+	now := time.Now().Unix()
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Storing a session",
+			s.SetSession,
+			[]any{&Session{1, "a", "u", now+10, now, now, "ua", "ip"}},
+			[]any{nil},
+		},
+		{
+			"Storing another session for the same user",
+			s.SetSession,
+			[]any{&Session{1, "b", "u", now+10, now+1, now+1, "ua", "ip"}},
+			[]any{nil},
+		},
+		{
+			"Storing an expired session for another user",
+			s.SetSession,
+			[]any{&Session{2, "a", "u", now-10, now, now, "ua", "ip"}},
+			[]any{nil},
+		},
+		{
+			"Updating a session",
+			s.SetSession,
+			[]any{&Session{1, "a", "v", now+20, now, now, "ua", "ip"}},
+			[]any{nil},
+		},
+		{
+			"Retrieving updated session",
+			s.GetSession,
+			[]any{UserId(1), "a"},
+			[]any{&Session{1, "a", "v", now+20, now, now, "ua", "ip"}, nil},
+		},
+		{
+			"Retrieving all user's sessions",
+			s.GetSessions,
+			[]any{UserId(1)},
+			[]any{[]Session{
+				{1, "a", "v", now+20, now, now, "ua", "ip"},
+				{1, "b", "u", now+10, now+1, now+1, "ua", "ip"},
+			}, nil},
+		},
+		{
+			"Retrieving an inexisting session",
+			s.GetSession,
+			[]any{UserId(1), "c"},
+			[]any{x, nil},
+		},
+		{
+			"Expiring sessions",
+			s.ExpireSessions,
+			[]any{now},
+			[]any{nil},
+		},
+		{
+			"Expired session is gone",
+			s.GetSession,
+			[]any{UserId(2), "a"},
+			[]any{x, nil},
+		},
+		{
+			"Removing a session",
+			s.RmSession,
+			[]any{UserId(1), "a"},
+			[]any{nil},
+		},
+		{
+			"Removed session is gone",
+			s.GetSession,
+			[]any{UserId(1), "a"},
+			[]any{x, nil},
+		},
+		{
+			"Other session is still there",
+			s.GetSession,
+			[]any{UserId(1), "b"},
+			[]any{&Session{1, "b", "u", now+10, now+1, now+1, "ua", "ip"}, nil},
+		},
+		{
+			"Removing all user's sessions",
+			s.RmSessions,
+			[]any{UserId(1)},
+			[]any{nil},
+		},
+		{
+			"All user's sessions are gone",
+			s.GetSession,
+			[]any{UserId(1), "b"},
+			[]any{x, nil},
+		},
+	})
+}
+
+func testRefreshStore(t *testing.T, s SessionStore) {
+	// nil refresh pointer
+	var x *Refresh
+
+	now := time.Now().Unix()
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Storing sessions",
+			func() error {
+				for _, x := range []*Session{
+					{3, "a", "u", now+10, now, now, "ua", "ip"},
+					{3, "b", "u", now+10, now, now, "ua", "ip"},
+					{4, "a", "u", now+10, now, now, "ua", "ip"},
+					{5, "a", "u", now-10, now, now, "ua", "ip"},
+				} {
+					if err := s.SetSession(x); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Storing refresh tokens",
+			func() error {
+				for _, r := range []*Refresh{
+					{"h3a", 3, "a", now, false},
+					{"h3b", 3, "b", now, false},
+					{"h4a", 4, "a", now, false},
+					{"h5a", 5, "a", now, false},
+				} {
+					if err := s.AddRefresh(r); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Using a refresh token",
+			s.UseRefresh,
+			[]any{"h3a"},
+			[]any{&Refresh{"h3a", 3, "a", now, false}, nil},
+		},
+		{
+			"Reusing a refresh token",
+			s.UseRefresh,
+			[]any{"h3a"},
+			[]any{&Refresh{"h3a", 3, "a", now, true}, nil},
+		},
+		{
+			"Using an inexisting refresh token",
+			s.UseRefresh,
+			[]any{"nope"},
+			[]any{x, nil},
+		},
+		{
+			"Removing a session",
+			s.RmSession,
+			[]any{UserId(3), "a"},
+			[]any{nil},
+		},
+		{
+			"Session's refresh tokens are gone",
+			s.UseRefresh,
+			[]any{"h3a"},
+			[]any{x, nil},
+		},
+		{
+			"Removing all user's sessions",
+			s.RmSessions,
+			[]any{UserId(3)},
+			[]any{nil},
+		},
+		{
+			"User's refresh tokens are gone",
+			s.UseRefresh,
+			[]any{"h3b"},
+			[]any{x, nil},
+		},
+		{
+			"Expiring sessions",
+			s.ExpireSessions,
+			[]any{now},
+			[]any{nil},
+		},
+		{
+			"Expired session's refresh tokens are gone",
+			s.UseRefresh,
+			[]any{"h5a"},
+			[]any{x, nil},
+		},
+		{
+			"Others are kept",
+			s.UseRefresh,
+			[]any{"h4a"},
+			[]any{&Refresh{"h4a", 4, "a", now, false}, nil},
+		},
+	})
+}
+
+func TestSessions(t *testing.T) {
+	initsqlitetest()
+
+	testSessionStore(t, db)
+	testSessionStore(t, NewMemSessions())
+}
+
+func TestRefreshes(t *testing.T) {
+	initsqlitetest()
+
+	testRefreshStore(t, db)
+	testRefreshStore(t, NewMemSessions())
+}
+
+func TestTOTPStore(t *testing.T) {
+	initsqlitetest()
+
+	var x *TOTP
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Registering a user",
+			db.AddUser,
+			[]any{&User{Name: "t", Email: "t", Passwd: "t"}},
+			[]any{nil},
+		},
+		{
+			"No secret yet",
+			db.GetTOTP,
+			[]any{UserId(1)},
+			[]any{x, nil},
+		},
+		{
+			"Pending secret",
+			db.SetTOTP,
+			[]any{&TOTP{UId: 1, Secret: "s0"}},
+			[]any{nil},
+		},
+		{
+			"Overwriting it",
+			db.SetTOTP,
+			[]any{&TOTP{UId: 1, Secret: "s1", Active: true, Last: 10}},
+			[]any{nil},
+		},
+		{
+			"Secret has been overwritten",
+			db.GetTOTP,
+			[]any{UserId(1)},
+			[]any{&TOTP{UId: 1, Secret: "s1", Active: true, Last: 10}, nil},
+		},
+		{
+			"Using a later step",
+			db.UseTOTP,
+			[]any{UserId(1), int64(11)},
+			[]any{true, nil},
+		},
+		{
+			"Replaying it",
+			db.UseTOTP,
+			[]any{UserId(1), int64(11)},
+			[]any{false, nil},
+		},
+		{
+			"Using an earlier step",
+			db.UseTOTP,
+			[]any{UserId(1), int64(9)},
+			[]any{false, nil},
+		},
+		{
+			"No secret, no step",
+			db.UseTOTP,
+			[]any{UserId(2), int64(12)},
+			[]any{false, nil},
+		},
+		{
+			"Challenge",
+			db.AddChallenge,
+			[]any{"tok", UserId(1), int64(42)},
+			[]any{nil},
+		},
+		{
+			"Removing the user",
+			func() error { _, err := db.RmUser(UserId(1)); return err },
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Secret is gone",
+			db.GetTOTP,
+			[]any{UserId(1)},
+			[]any{x, nil},
+		},
+		{
+			"Challenge is gone",
+			db.PopChallenge,
+			[]any{"tok"},
+			[]any{UserId(0), int64(0), fmt.Errorf("Invalid token")},
+		},
+	})
+}
+
+func TestRecoveryStore(t *testing.T) {
+	initsqlitetest()
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Registering a user",
+			db.AddUser,
+			[]any{&User{Name: "t", Email: "t", Passwd: "t"}},
+			[]any{nil},
+		},
+		{
+			"No codes yet",
+			db.CountRecovery,
+			[]any{UserId(1)},
+			[]any{0, nil},
+		},
+		{
+			"Storing codes",
+			db.SetRecovery,
+			[]any{UserId(1), []string{"h0", "h1", "h2"}},
+			[]any{nil},
+		},
+		{
+			"Counting them",
+			db.CountRecovery,
+			[]any{UserId(1)},
+			[]any{3, nil},
+		},
+		{
+			"Using one",
+			db.UseRecovery,
+			[]any{UserId(1), "h1"},
+			[]any{true, nil},
+		},
+		{
+			"Using it twice",
+			db.UseRecovery,
+			[]any{UserId(1), "h1"},
+			[]any{false, nil},
+		},
+		{
+			"Someone else's code",
+			db.UseRecovery,
+			[]any{UserId(2), "h0"},
+			[]any{false, nil},
+		},
+		{
+			"One less",
+			db.CountRecovery,
+			[]any{UserId(1)},
+			[]any{2, nil},
+		},
+		{
+			"Replacing codes",
+			db.SetRecovery,
+			[]any{UserId(1), []string{"h3"}},
+			[]any{nil},
+		},
+		{
+			"Previous codes are gone",
+			db.UseRecovery,
+			[]any{UserId(1), "h0"},
+			[]any{false, nil},
+		},
+		{
+			"Removing the user",
+			func() error { _, err := db.RmUser(UserId(1)); return err },
+			[]any{},
+			[]any{nil},
+		},
+		{
+			"Codes are gone",
+			db.CountRecovery,
+			[]any{UserId(1)},
+			[]any{0, nil},
+		},
+	})
+}
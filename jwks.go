@@ -0,0 +1,115 @@
+package auth
+
+// Publication of the public key(s) as a JWK Set (RFC 7517), so
+// that resource servers can verify our tokens on their own.
+//
+// Keys are identified by their RFC 7638 thumbprint, which is
+// also the "kid" header of the tokens they sign.
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+)
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func b64(xs []byte) string {
+	return base64.RawURLEncoding.EncodeToString(xs)
+}
+
+// Public JWK for a (P-256) ECDSA, Ed25519 or RSA key; false
+// for other keys (e.g. HMAC secrets).
+func mkJWK(pub any, alg string) (JWK, bool) {
+	k := JWK{Use : "sig", Alg : alg}
+
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		n := (p.Curve.Params().BitSize+7)/8
+		k.Kty = "EC"
+		k.Crv = p.Curve.Params().Name
+		k.X   = b64(p.X.FillBytes(make([]byte, n)))
+		k.Y   = b64(p.Y.FillBytes(make([]byte, n)))
+	case ed25519.PublicKey:
+		k.Kty = "OKP"
+		k.Crv = "Ed25519"
+		k.X   = b64(p)
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N   = b64(p.N.Bytes())
+		k.E   = b64(big.NewInt(int64(p.E)).Bytes())
+	default:
+		return JWK{}, false
+	}
+
+	k.Kid = thumbprint(k)
+	return k, true
+}
+
+// RFC 7638: hash of the required members, in lexicographic
+// order, without whitespaces.
+func thumbprint(k JWK) string {
+	m := map[string]string{"kty" : k.Kty}
+	switch k.Kty {
+	case "EC":
+		m["crv"], m["x"], m["y"] = k.Crv, k.X, k.Y
+	case "OKP":
+		m["crv"], m["x"] = k.Crv, k.X
+	case "RSA":
+		m["e"], m["n"] = k.E, k.N
+	}
+
+	// NOTE: json.Marshal() sorts map keys
+	xs, _ := json.Marshal(m)
+	h := sha256.Sum256(xs)
+	return b64(h[:])
+}
+
+// Public keys, including those only used for verification;
+// HMAC secrets can't be published.
+func (a *Auth) JWKS() JWKS {
+	ks := JWKS{Keys: []JWK{}}
+	for _, k := range a.getKeys().list() {
+		if jwk, ok := mkJWK(k.verify, k.method.Alg()); ok {
+			ks.Keys = append(ks.Keys, jwk)
+		}
+	}
+	return ks
+}
+
+// NOTE: this one isn't a RPC (GET, no JSON input).
+func (a *Auth) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	// Allow rotations to propagate reasonably fast
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	if err := json.NewEncoder(w).Encode(a.JWKS()); err != nil {
+		fails(w, &intErr{err.Error()})
+	}
+}
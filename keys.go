@@ -0,0 +1,418 @@
+package auth
+
+// Signing keys: a current one, used to sign new tokens, and
+// a set of verification keys, selected by the tokens' "kid"
+// header. Keys no longer used for signing can then be kept
+// around until the tokens they signed have expired, so that
+// rotating a key doesn't log everyone out.
+//
+// The set can be reloaded at runtime (ReloadKeys()), from an
+// updated configuration.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type sigKey struct {
+	kid    string
+	method jwt.SigningMethod
+	sign   any // nil for verification-only keys
+	verify any
+}
+
+// NOTE: immutable once built; replaced as a whole on reloads.
+type keySet struct {
+	cur  *sigKey
+	keys map[string]*sigKey
+}
+
+func (ks *keySet) add(k *sigKey) {
+	ks.keys[k.kid] = k
+}
+
+// Verification keys, sorted by kid (stable JWKS output)
+func (ks *keySet) list() []*sigKey {
+	xs := make([]*sigKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		xs = append(xs, k)
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].kid < xs[j].kid })
+	return xs
+}
+
+// Accepted tokens' algorithms
+func (ks *keySet) algs() []string {
+	m := map[string]bool{}
+	for _, k := range ks.keys {
+		m[k.method.Alg()] = true
+	}
+	xs := make([]string, 0, len(m))
+	for alg := range m {
+		xs = append(xs, alg)
+	}
+	sort.Strings(xs)
+	return xs
+}
+
+// Supported algorithms
+var methods = map[string]jwt.SigningMethod{
+	"HS256" : jwt.SigningMethodHS256,
+	"ES256" : jwt.SigningMethodES256,
+	"EdDSA" : jwt.SigningMethodEdDSA,
+	"RS256" : jwt.SigningMethodRS256,
+	"PS256" : jwt.SigningMethodPS256,
+}
+
+// NOTE: the kid is derived from the secret; that's no worse
+// than the signature itself regarding brute-force attacks.
+func hmacKey(secret string) *sigKey {
+	h := sha256.Sum256([]byte("kid:"+secret))
+	return &sigKey{
+		kid    : "hmac-"+b64(h[:12]),
+		method : jwt.SigningMethodHS256,
+		sign   : []byte(secret),
+		verify : []byte(secret),
+	}
+}
+
+// Does the (public) key fit the signing method?
+func keyFits(m jwt.SigningMethod, pub crypto.PublicKey) bool {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return m == jwt.SigningMethodES256 && k.Curve == elliptic.P256()
+	case ed25519.PublicKey:
+		return m == jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		return (m == jwt.SigningMethodRS256 || m == jwt.SigningMethodPS256) &&
+			k.N.BitLen() >= 2048
+	}
+	return false
+}
+
+// Default method for a public key; RSA keys can be used
+// either with RS256 or PS256 (rsaMethod).
+func methodFor(pub crypto.PublicKey, rsaMethod jwt.SigningMethod) jwt.SigningMethod {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA
+	case *rsa.PublicKey:
+		return rsaMethod
+	}
+	return nil
+}
+
+// priv may be nil (verification key)
+func asymKey(m jwt.SigningMethod, priv crypto.Signer, pub crypto.PublicKey) (*sigKey, error) {
+	if !keyFits(m, pub) {
+		return nil, fmt.Errorf("Key type doesn't fit %s", m.Alg())
+	}
+	jwk, _ := mkJWK(pub, m.Alg())
+	k := &sigKey{
+		kid    : jwk.Kid,
+		method : m,
+		verify : pub,
+	}
+	if priv != nil {
+		k.sign = priv
+	}
+	return k, nil
+}
+
+// PEM-encoded PKCS#8, SEC 1 (EC) or PKCS#1 (RSA) private key
+func parsePrivatePEM(xs []byte) (crypto.Signer, error) {
+	b, _ := pem.Decode(xs)
+	if b == nil || !strings.HasSuffix(b.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("No PEM private key found")
+	}
+
+	var k any
+	var err error
+	switch b.Type {
+	case "EC PRIVATE KEY":
+		k, err = x509.ParseECPrivateKey(b.Bytes)
+	case "RSA PRIVATE KEY":
+		k, err = x509.ParsePKCS1PrivateKey(b.Bytes)
+	default:
+		k, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type")
+	}
+	return s, nil
+}
+
+// PEM-encoded PKIX or PKCS#1 (RSA) public key
+func parsePublicPEM(xs []byte) (crypto.PublicKey, error) {
+	b, _ := pem.Decode(xs)
+	if b == nil {
+		return nil, fmt.Errorf("No PEM public key found")
+	}
+	switch b.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(b.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(b.Bytes)
+	}
+	return nil, fmt.Errorf("No PEM public key found")
+}
+
+// Load a PEM-encoded private (preferred) or public key,
+// for verification only.
+func loadPEMKey(fn string, rsaMethod jwt.SigningMethod) (*sigKey, error) {
+	xs, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load key: %s", err)
+	}
+
+	var pub crypto.PublicKey
+	if priv, err := parsePrivatePEM(xs); err == nil {
+		pub = priv.Public()
+	} else if pub, err = parsePublicPEM(xs); err != nil {
+		return nil, fmt.Errorf("Key parsing error (%s): %s", fn, err)
+	}
+
+	m := methodFor(pub, rsaMethod)
+	if m == nil {
+		return nil, fmt.Errorf("Unsupported key type (%s)", fn)
+	}
+
+	k, err := asymKey(m, nil, pub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return k, nil
+}
+
+// Signing method, as configured
+func (c *Config) method() (jwt.SigningMethod, error) {
+	alg := c.Alg
+	if alg == "" {
+		// Historical behavior
+		alg = "HS256"
+		if c.PrivateKey != "" {
+			alg = "ES256"
+		}
+	}
+	m, ok := methods[alg]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Alg: '%s'", alg)
+	}
+	return m, nil
+}
+
+// Load the current key pair referenced by the configuration
+func (c *Config) loadKeys(m jwt.SigningMethod) (*sigKey, error) {
+	priv, err := ioutil.ReadFile(c.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load private key: %s", err)
+	}
+
+	privateKey, err := parsePrivatePEM(priv)
+	if err != nil {
+		return nil, fmt.Errorf("Private key (.pem) parsing error: %s", err)
+	}
+
+	// Optional, can be derived from the private key
+	if c.PublicKey != "" {
+		pub, err := ioutil.ReadFile(c.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load public key: %s", err)
+		}
+
+		publicKey, err := parsePublicPEM(pub)
+		if err != nil {
+			return nil, fmt.Errorf("Public key parsing error: %s", err)
+		}
+
+		x, ok := publicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !x.Equal(privateKey.Public()) {
+			return nil, fmt.Errorf("Public key doesn't match private key")
+		}
+	}
+
+	return asymKey(m, privateKey, privateKey.Public())
+}
+
+// Build the key set described by the configuration: a key pair
+// (or HMAC secret) to sign, plus verification keys (old HMAC
+// secrets, VerifyKeys files, KeyDir's *.pem).
+//
+// Verification RSA keys are used with Alg if it's RS256/PS256,
+// RS256 otherwise.
+func (c *Config) loadKeySet() (*keySet, error) {
+	ks := &keySet{keys: map[string]*sigKey{}}
+
+	m, err := c.method()
+	if err != nil {
+		return nil, err
+	}
+
+	if m == jwt.SigningMethodHS256 {
+		if c.HMAC == "" {
+			return nil, fmt.Errorf("HS256 requires a HMAC")
+		}
+		ks.cur = hmacKey(c.HMAC)
+	} else {
+		if c.PrivateKey == "" {
+			return nil, fmt.Errorf("%s requires a PrivateKey", m.Alg())
+		}
+		if ks.cur, err = c.loadKeys(m); err != nil {
+			return nil, err
+		}
+	}
+
+	rsaMethod := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if m == jwt.SigningMethodPS256 {
+		rsaMethod = m
+	}
+
+	for _, s := range c.OldHMACs {
+		ks.add(hmacKey(s))
+	}
+
+	fns := append([]string{}, c.VerifyKeys...)
+	if c.KeyDir != "" {
+		xs, err := filepath.Glob(filepath.Join(c.KeyDir, "*.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list keys: %s", err)
+		}
+		fns = append(fns, xs...)
+	}
+
+	for _, fn := range fns {
+		k, err := loadPEMKey(fn, rsaMethod)
+		if err != nil {
+			return nil, err
+		}
+		ks.add(k)
+	}
+
+	// last, so that it isn't downgraded to verification-only
+	ks.add(ks.cur)
+
+	return ks, nil
+}
+
+// Generate a key pair for alg (but HS256), PEM-encoded
+// (PKCS#8 private key, PKIX public key).
+func GenKey(alg string) ([]byte, []byte, error) {
+	var priv crypto.Signer
+	var err error
+
+	switch alg {
+	case "ES256":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256", "PS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, nil, fmt.Errorf("Cannot generate keys for '%s'", alg)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	xs, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	ys, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: xs}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ys}), nil
+}
+
+func (a *Auth) getKeys() *keySet {
+	a.keysMu.RLock()
+	defer a.keysMu.RUnlock()
+	return a.keys
+}
+
+// Reload the key set from c, e.g. a freshly read configuration
+// after a key rotation; only the key settings are used. On
+// error, the current set is kept.
+func (a *Auth) ReloadKeys(c *Config) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	return a.setKeys(c)
+}
+
+func (a *Auth) setKeys(c *Config) error {
+	ks, err := c.loadKeySet()
+	if err != nil {
+		return err
+	}
+
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	a.keys = ks
+	return nil
+}
+
+// Reload the keys from load()'s configuration whenever one of
+// sigs (default: SIGHUP) is received; the returned function
+// stops listening. load is typically:
+//
+//	func() (*Config, error) { return ReadConf(fn) }
+func (a *Auth) ReloadKeysOnSignal(load func() (*Config, error), sigs ...os.Signal) func() {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-ch:
+				c, err := load()
+				if err == nil {
+					err = a.ReloadKeys(c)
+				}
+				if err != nil {
+					log.Println("Cannot reload keys:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -1,21 +1,155 @@
 package auth
 
 import (
+	"fmt"
 	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-// sendEmail sends an email to an user.
-func sendEmail(to, subject, msg string) error {
+// Mailer sends an email to an user.
+type Mailer interface {
+	Send(to, subject, msg string) error
+}
+
+// SMTPMailer sends emails through an authenticated
+// SMTP server.
+type SMTPMailer struct {
+	Server string
+	Port   string
+	Email  string
+	Passwd string
+}
+
+func (m *SMTPMailer) Send(to, subject, msg string) error {
 	body := "To: " + to + "\r\nSubject: " +
 		subject + "\r\n\r\n" + msg
 
-	auth := smtp.PlainAuth("", C.AuthEmail, C.AuthPasswd, C.SMTPServer)
+	auth := smtp.PlainAuth("", m.Email, m.Passwd, m.Server)
+
+	return smtp.SendMail(m.Server+":"+m.Port,
+		auth, m.Email, []string{to}, []byte(body))
+}
+
+type Mail struct {
+	To      string
+	Subject string
+	Msg     string
+}
+
+// MemMailer records emails in memory (tests).
+type MemMailer struct {
+	sync.Mutex
+	Mails []Mail
+}
 
-	err := smtp.SendMail(C.SMTPServer+":"+C.SMTPPort,
-		auth, C.AuthEmail, []string{to}, []byte(body))
+func (m *MemMailer) Send(to, subject, msg string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.Mails = append(m.Mails, Mail{to, subject, msg})
+	return nil
+}
+
+// Last returns the last email sent to the given address,
+// if any.
+func (m *MemMailer) Last(to string) (Mail, bool) {
+	m.Lock()
+	defer m.Unlock()
+	for i := len(m.Mails)-1; i >= 0; i-- {
+		if m.Mails[i].To == to {
+			return m.Mails[i], true
+		}
+	}
+	return Mail{}, false
+}
+
+// DirMailer writes emails to files in a directory (dev).
+type DirMailer struct {
+	Dir string
+}
+
+func (m *DirMailer) Send(to, subject, msg string) error {
+	// e.g. 1726412345123456789-foo@bar.com.eml
+	fn := filepath.Join(m.Dir, fmt.Sprintf("%d-%s.eml",
+		time.Now().UnixNano(), strings.ReplaceAll(to, "/", "_")))
+
+	body := "To: " + to + "\nSubject: " + subject + "\n\n" + msg + "\n"
+
+	return os.WriteFile(fn, []byte(body), 0600)
+}
+
+// Default mailer, as configured.
+func (c *Config) mailer() Mailer {
+	if c.MailDir != "" {
+		return &DirMailer{c.MailDir}
+	}
+	return &SMTPMailer{c.SMTPServer, c.SMTPPort, c.AuthEmail, c.AuthPasswd}
+}
+
+// Build a link to a frontend page from a base URL,
+// passing tok as a "token" query parameter.
+func mkLink(base, tok string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("token", tok)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Send an email containing a link to base, with tok
+// as a parameter.
+func (a *Auth) sendLinkEmail(to, base, tok, subject, before, after string) error {
+	link, err := mkLink(base, tok)
 	if err != nil {
-		return err
+		return &intErr{err.Error()}
+	}
+
+	err = a.mailer.Send(to, subject, before+"\n\n\t"+link+"\n\n"+after)
+	if err != nil {
+		return &intErr{"Cannot send email: "+err.Error()}
+	}
+	return nil
+}
+
+func (a *Auth) sendVerifEmail(to, tok string) error {
+	return a.sendLinkEmail(to, a.c.VerifURL, tok, "Email verification",
+		"Please follow this link to verify your email address:",
+		"If you didn't ask for an account, you can ignore this email.")
+}
+
+func (a *Auth) sendResetEmail(to, tok string) error {
+	return a.sendLinkEmail(to, a.c.ResetURL, tok, "Password reset",
+		"Please follow this link to reset your password:",
+		"If you didn't ask for a password reset, you can ignore this email.")
+}
+
+func (a *Auth) sendLockEmail(to string, d int64) error {
+	msg := fmt.Sprintf("Your account has been locked for %s, after too many "+
+		"failed login attempts.\n\nIf those weren't yours, someone may be "+
+		"trying to guess your password: consider changing it.",
+		time.Duration(d)*time.Second)
+
+	if err := a.mailer.Send(to, "Account locked", msg); err != nil {
+		return &intErr{"Cannot send email: "+err.Error()}
 	}
+	return nil
+}
 
+func (a *Auth) sendSigninEmail(to string) error {
+	msg := "Someone tried to create an account with this email address, " +
+		"which is already registered.\n\nIf it was you, you can log in " +
+		"with your existing account, or reset your password if you forgot " +
+		"it. Otherwise, you can ignore this email."
+
+	if err := a.mailer.Send(to, "Account creation attempt", msg); err != nil {
+		return &intErr{"Cannot send email: "+err.Error()}
+	}
 	return nil
 }
@@ -0,0 +1,107 @@
+package auth
+
+// Middlewares for services built on top of an Auth:
+// RequireAuth()/OptionalAuth() validate the request's token
+// and make the UserId available to the wrapped handler,
+// via UserIdFrom().
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type ctxKey int
+
+const (
+	uidKey ctxKey = iota
+)
+
+// Retrieve the UserId stored in the context by RequireAuth()
+// or OptionalAuth(); (-1, false) if the user isn't connected.
+func UserIdFrom(ctx context.Context) (UserId, bool) {
+	uid, ok := ctx.Value(uidKey).(UserId)
+	if !ok {
+		return -1, false
+	}
+	return uid, true
+}
+
+// Only let connected users reach h; others get a 401 and
+// a SomeErr.
+func (a *Auth) RequireAuth(h http.Handler) http.Handler {
+	return a.authenticate(h, true)
+}
+
+// Let everyone reach h; UserIdFrom() tells whether the
+// user is connected.
+func (a *Auth) OptionalAuth(h http.Handler) http.Handler {
+	return a.authenticate(h, false)
+}
+
+func isSafeMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
+
+func (a *Auth) authenticate(h http.Handler, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, bearer, err := a.getToken(w, r)
+		if err != nil {
+			fails(w, &authErr{err.Error()})
+			return
+		}
+
+		// Same checks as Wrap() for cookie-authenticated requests;
+		// safe methods (e.g. page loads from links) are let through,
+		// and are expected to be free of side-effects.
+		if !bearer && tok != "" && !isSafeMethod(r.Method) {
+			if err := a.checkOrigin(r); err != nil {
+				fails(w, err)
+				return
+			}
+			if err := a.checkCSRF(r, tok); err != nil {
+				fails(w, err)
+				return
+			}
+		}
+
+		ok, uid, err := a.CheckToken(tok)
+		if _, ie := err.(*intErr); ie {
+			fails(w, err)
+			return
+		}
+
+		if err != nil || !ok {
+			// Don't keep sending an invalid token around
+			if tok != "" && a.useCookie(r, bearer) {
+				a.RstCookie(w)
+			}
+			if required {
+				fails(w, &authErr{"Not connected!"})
+			} else {
+				h.ServeHTTP(w, r)
+			}
+			return
+		}
+
+		// XXX concurrent requests from the same session
+		// (e.g. multiple fetch()) will race to chain.
+		//
+		// NOTE: we can't send back a chained token without
+		// a cookie: such clients are expected to use /chain.
+		//
+		// Short-lived tokens are refreshed by the client instead.
+		if a.c.AuthChain && a.useCookie(r, bearer) {
+			tok, err = a.ChainToken(tok)
+			if err == nil {
+				a.SetCookie(w, tok)
+			} else if !errors.Is(err, errRefreshable) {
+				fails(w, fmt.Errorf("Chaining failure: %s", err))
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uidKey, uid)))
+	})
+}
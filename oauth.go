@@ -0,0 +1,185 @@
+package auth
+
+// OAuth-style endpoints, for resource servers which can't verify
+// tokens on their own (RFC 7662), or clients which need to revoke
+// them (RFC 7009). Those aren't RPCs: inputs are form-encoded, and
+// callers authenticate with a client credential (Config.Clients),
+// either via HTTP Basic or client_id/client_secret form parameters.
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// RFC 7662 response; only Active is set for inactive tokens.
+//
+// NOTE: we have no scopes (yet), nor clients tokens are issued to.
+type IntrospectOut struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	TokType  string `json:"token_type,omitempty"`
+}
+
+// RFC 6749 error response
+type OAuthErr struct {
+	Err string `json:"error"`
+}
+
+func writeOAuth(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Authenticate the calling client; constant time
+// wrt. the secret (and to some extent, the id).
+func (a *Auth) checkClient(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+
+	exp, found := a.c.Clients[id]
+
+	// Hash, so that lengths don't leak
+	x := sha256.Sum256([]byte(secret))
+	y := sha256.Sum256([]byte(exp))
+
+	return subtle.ConstantTimeCompare(x[:], y[:]) == 1 && found && id != ""
+}
+
+// Common prologue: POST, form-encoded, authenticated client.
+func (a *Auth) oauthPrologue(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeOAuth(w, http.StatusMethodNotAllowed, &OAuthErr{"invalid_request"})
+		return false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuth(w, http.StatusBadRequest, &OAuthErr{"invalid_request"})
+		return false
+	}
+
+	if !a.checkClient(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+		writeOAuth(w, http.StatusUnauthorized, &OAuthErr{"invalid_client"})
+		return false
+	}
+
+	if r.PostFormValue("token") == "" {
+		writeOAuth(w, http.StatusBadRequest, &OAuthErr{"invalid_request"})
+		return false
+	}
+
+	return true
+}
+
+// Is the token (still) valid? Refresh tokens are never
+// considered active here.
+func (a *Auth) Introspect(tok string) (*IntrospectOut, error) {
+	claims, err := a.ParseToken(tok)
+	if err != nil {
+		return &IntrospectOut{}, nil
+	}
+
+	s, err := a.getSession(claims)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return &IntrospectOut{}, nil
+	}
+
+	uid, _ := claimsSession(claims)
+	_, exp := claimsUniq(claims)
+	iat, _ := claims["iat"].(float64)
+
+	return &IntrospectOut{
+		Active  : true,
+		Sub     : strconv.FormatInt(int64(uid), 10),
+		Exp     : exp,
+		Iat     : int64(iat),
+		TokType : "Bearer",
+	}, nil
+}
+
+func (a *Auth) serveIntrospect(w http.ResponseWriter, r *http.Request) {
+	if !a.oauthPrologue(w, r) {
+		return
+	}
+
+	out, err := a.Introspect(r.PostFormValue("token"))
+	if err != nil {
+		writeOAuth(w, http.StatusInternalServerError, &OAuthErr{"server_error"})
+		return
+	}
+
+	writeOAuth(w, http.StatusOK, out)
+}
+
+// Revoke the session a token (short-lived/regular or refresh)
+// belongs to; unknown, invalid or expired tokens are ignored.
+// hint is "access_token", "refresh_token" or "".
+func (a *Auth) Revoke(tok, hint string) error {
+	revokeAccess := func() (bool, error) {
+		claims, err := a.ParseToken(tok)
+		if err != nil {
+			return false, nil
+		}
+		s, err := a.getSession(claims)
+		if err != nil || s == nil {
+			return false, err
+		}
+		return true, a.sessions.RmSession(s.UId, s.Id)
+	}
+
+	// NOTE: the refresh token is consumed; that's fine, as its
+	// family is about to be removed.
+	revokeRefresh := func() (bool, error) {
+		r, err := a.sessions.UseRefresh(hashRefresh(tok))
+		if err != nil || r == nil {
+			return false, err
+		}
+		return true, a.sessions.RmSession(r.UId, r.SId)
+	}
+
+	fs := []func() (bool, error){revokeAccess, revokeRefresh}
+	if hint == "refresh_token" {
+		fs[0], fs[1] = fs[1], fs[0]
+	}
+
+	for _, f := range fs {
+		done, err := f()
+		if err != nil {
+			return &intErr{err.Error()}
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (a *Auth) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	if !a.oauthPrologue(w, r) {
+		return
+	}
+
+	err := a.Revoke(r.PostFormValue("token"), r.PostFormValue("token_type_hint"))
+	if err != nil {
+		writeOAuth(w, http.StatusInternalServerError, &OAuthErr{"server_error"})
+		return
+	}
+
+	// Always 200, whether the token was known or not
+	writeOAuth(w, http.StatusOK, struct{}{})
+}
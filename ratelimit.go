@@ -0,0 +1,231 @@
+package auth
+
+// Rate limiting of sensitive routes (password guessing, mass
+// signins, etc.), by client IP and by target account. Limits are
+// token buckets: up to Burst requests at once, refilled at a rate
+// of Burst requests per Window seconds.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Burst == 0 disables the limit
+type RateLimit struct {
+	Burst  int
+	Window int64
+}
+
+// Limits of a route; the login is read from the JSON input
+// ("login", or "email" for /signin).
+type RouteLimits struct {
+	IP    RateLimit
+	Login RateLimit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	sync.Mutex
+	rate  float64 // tokens per second
+	burst float64
+	bs    map[string]*bucket
+	sweep time.Time
+}
+
+func newLimiter(l RateLimit) *limiter {
+	if l.Burst <= 0 || l.Window <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate  : float64(l.Burst)/float64(l.Window),
+		burst : float64(l.Burst),
+		bs    : map[string]*bucket{},
+	}
+}
+
+// Consume a token from key's bucket; if there's none, tell
+// how long to wait for the next one.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	// Forget about refilled buckets from time to time
+	if now.Sub(l.sweep) > time.Minute {
+		for k, b := range l.bs {
+			if l.refill(b, now) >= l.burst {
+				delete(l.bs, k)
+			}
+		}
+		l.sweep = now
+	}
+
+	b, ok := l.bs[key]
+	if !ok {
+		b = &bucket{l.burst, now}
+		l.bs[key] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1-b.tokens)/l.rate*float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+type routeLimiter struct {
+	ip    *limiter
+	login *limiter
+}
+
+func newRouteLimiters(ls map[string]RouteLimits) map[string]*routeLimiter {
+	xs := map[string]*routeLimiter{}
+	for path, l := range ls {
+		xs[path] = &routeLimiter{newLimiter(l.IP), newLimiter(l.Login)}
+	}
+	return xs
+}
+
+// Parse Config.TrustedProxies (IPs or CIDRs)
+func parseProxies(xs []string) ([]*net.IPNet, error) {
+	ns := []*net.IPNet{}
+	for _, s := range xs {
+		x := s
+		if !strings.Contains(x, "/") {
+			if ip := net.ParseIP(x); ip != nil && ip.To4() != nil {
+				x += "/32"
+			} else {
+				x += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TrustedProxies entry: '%s'", s)
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+func (a *Auth) isTrusted(ip string) bool {
+	x := net.ParseIP(ip)
+	if x == nil {
+		return false
+	}
+	for _, n := range a.proxies {
+		if n.Contains(x) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client's IP: the connection's, unless it comes from a
+// trusted proxy, in which case X-Forwarded-For is walked
+// from the right, skipping trusted proxies.
+func (a *Auth) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !a.isTrusted(ip) {
+		return ip
+	}
+
+	var xs []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, x := range strings.Split(h, ",") {
+			xs = append(xs, strings.TrimSpace(x))
+		}
+	}
+
+	for i := len(xs)-1; i >= 0; i-- {
+		if net.ParseIP(xs[i]) == nil {
+			// Garbage: can't go further
+			break
+		}
+		ip = xs[i]
+		if !a.isTrusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Login targeted by a request, from its JSON body (which is
+// restored for the next handler).
+func peekLogin(r *http.Request) (string, error) {
+	// NOTE: inputs are small; 1MB is plenty
+	xs, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(xs))
+
+	var in struct {
+		Login string `json:"login"`
+		Email string `json:"email"`
+	}
+	// Invalid inputs are reported later on
+	json.Unmarshal(xs, &in)
+
+	if in.Login == "" {
+		in.Login = in.Email
+	}
+	return strings.ToLower(in.Login), nil
+}
+
+// Apply path's rate limits (if any) to h
+func (a *Auth) limit(path string, h http.HandlerFunc) http.HandlerFunc {
+	l, ok := a.limiters[path]
+	if !ok {
+		return h
+	}
+
+	tooMany := func(w http.ResponseWriter, d time.Duration) {
+		w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(d.Seconds()))))
+		fails(w, &limitErr{"Too many requests"})
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		if l.ip != nil {
+			if ok, d := l.ip.allow(a.clientIP(r), now); !ok {
+				tooMany(w, d)
+				return
+			}
+		}
+
+		if l.login != nil {
+			login, err := peekLogin(r)
+			if err != nil {
+				fails(w, err)
+				return
+			}
+			if login != "" {
+				if ok, d := l.login.allow(login, now); !ok {
+					tooMany(w, d)
+					return
+				}
+			}
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mbivert/ftests"
+)
+
+// allow() outputs for successive requests, at the given
+// offsets (seconds) from t0
+func allowAt(l RateLimit, key string, offsets ...float64) []any {
+	t0 := time.Unix(1700000000, 0)
+	lim := newLimiter(l)
+
+	xs := []any{}
+	for _, o := range offsets {
+		ok, d := lim.allow(key, t0.Add(time.Duration(o*float64(time.Second))))
+		xs = append(xs, ok, d.Seconds())
+	}
+	return xs
+}
+
+func TestLimiter(t *testing.T) {
+	ftests.Run(t, []ftests.Test{
+		{
+			"Disabled",
+			func() bool { return newLimiter(RateLimit{0, 60}) == nil },
+			[]any{},
+			[]any{true},
+		},
+		{
+			"Burst, then wait for a refill",
+			allowAt,
+			[]any{RateLimit{2, 60}, "k", 0., 0., 0., 15., 30., 30.},
+			[]any{[]any{
+				true, 0.,
+				true, 0.,
+				false, 30.,
+				false, 15.,
+				true, 0.,
+				false, 30.,
+			}},
+		},
+		{
+			"Buckets are capped",
+			allowAt,
+			[]any{RateLimit{1, 10}, "k", 0., 3600., 3600.},
+			[]any{[]any{
+				true, 0.,
+				true, 0.,
+				false, 10.,
+			}},
+		},
+		{
+			"Keys are independent",
+			func() []any {
+				lim := newLimiter(RateLimit{1, 60})
+				now := time.Now()
+				a, _ := lim.allow("a", now)
+				b, _ := lim.allow("b", now)
+				c, _ := lim.allow("a", now)
+				return []any{a, b, c}
+			},
+			[]any{},
+			[]any{[]any{true, true, false}},
+		},
+		{
+			"Refilled buckets are swept",
+			func() int {
+				lim := newLimiter(RateLimit{1, 60})
+				now := time.Now()
+				lim.allow("a", now)
+				lim.allow("b", now.Add(2*time.Minute))
+				return len(lim.bs)
+			},
+			[]any{},
+			[]any{1},
+		},
+	})
+}
+
+// clientIP() for a request from remote, with some X-Forwarded-For
+func clientIPFor(proxies []string, remote string, xff ...string) string {
+	ns, err := parseProxies(proxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a := &Auth{proxies: ns}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = remote
+	for _, x := range xff {
+		r.Header.Add("X-Forwarded-For", x)
+	}
+	return a.clientIP(r)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.0.2.1", "::1"}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"No proxy",
+			clientIPFor,
+			[]any{[]string{}, "203.0.113.7:1234", "1.2.3.4"},
+			[]any{"203.0.113.7"},
+		},
+		{
+			"Untrusted proxy",
+			clientIPFor,
+			[]any{trusted, "203.0.113.7:1234", "1.2.3.4"},
+			[]any{"203.0.113.7"},
+		},
+		{
+			"Trusted proxy",
+			clientIPFor,
+			[]any{trusted, "192.0.2.1:1234", "1.2.3.4"},
+			[]any{"1.2.3.4"},
+		},
+		{
+			"Trusted proxies chain; spoofed leftmost entry",
+			clientIPFor,
+			[]any{trusted, "10.1.2.3:1234", "6.6.6.6, 1.2.3.4", "10.0.0.1"},
+			[]any{"1.2.3.4"},
+		},
+		{
+			"IPv6 trusted proxy",
+			clientIPFor,
+			[]any{trusted, "[::1]:1234", "2001:db8::1"},
+			[]any{"2001:db8::1"},
+		},
+		{
+			"Garbage in X-Forwarded-For",
+			clientIPFor,
+			[]any{trusted, "192.0.2.1:1234", "whatever"},
+			[]any{"192.0.2.1"},
+		},
+		{
+			"Only trusted proxies",
+			clientIPFor,
+			[]any{trusted, "192.0.2.1:1234", "10.0.0.1"},
+			[]any{"10.0.0.1"},
+		},
+		{
+			"Invalid proxy",
+			func() string {
+				_, err := parseProxies([]string{"10.0.0.0/33"})
+				return err.Error()
+			},
+			[]any{},
+			[]any{"Invalid TrustedProxies entry: '10.0.0.0/33'"},
+		},
+	})
+}
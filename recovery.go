@@ -0,0 +1,132 @@
+package auth
+
+// Single-use recovery codes, accepted by /2fa/login in place
+// of a TOTP code (e.g. lost device). They're generated when
+// 2FA is activated (/2fa/confirm), and can be regenerated
+// (/2fa/recovery/regen); only their hashes are stored.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	recoveryCount = 10
+	recoveryLen   = 10 // random bytes (80 bits)
+)
+
+// e.g. "abcd-efgh-ijkl-mnop"
+func mkRecoveryCode() (string, error) {
+	xs := make([]byte, recoveryLen)
+	if _, err := rand.Read(xs); err != nil {
+		return "", &intErr{err.Error()}
+	}
+
+	s := strings.ToLower(b32.EncodeToString(xs))
+
+	var parts []string
+	for i := 0; i < len(s); i += 4 {
+		parts = append(parts, s[i:min(i+4, len(s))])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// Codes are hashed once normalized (case, separators); they're
+// random enough for a fast hash.
+func hashRecovery(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	h := sha256.Sum256([]byte("recovery:"+code))
+	return hex.EncodeToString(h[:])
+}
+
+// (Re)generate uid's recovery codes; previous ones are dropped.
+func (a *Auth) newRecoveryCodes(uid UserId) ([]string, error) {
+	codes := make([]string, recoveryCount)
+	hashes := make([]string, recoveryCount)
+
+	for i := range codes {
+		c, err := mkRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = c, hashRecovery(c)
+	}
+
+	if err := a.db.SetRecovery(uid, hashes); err != nil {
+		return nil, &intErr{err.Error()}
+	}
+	return codes, nil
+}
+
+// Consume one of uid's recovery codes, if code is one
+func (a *Auth) useRecoveryCode(uid UserId, code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+	ok, err := a.db.UseRecovery(uid, hashRecovery(code))
+	if err != nil {
+		return false, &intErr{err.Error()}
+	}
+	return ok, nil
+}
+
+// Check that tok is the session of a user with an
+// active second factor.
+func (a *Auth) get2FAUser(tok string) (UserId, error) {
+	ok, uid, err := a.CheckToken(tok)
+	if err != nil {
+		return -1, err
+	}
+	if !ok {
+		return -1, fmt.Errorf("Not connected!")
+	}
+
+	t, err := a.db.GetTOTP(uid)
+	if err != nil {
+		return -1, &intErr{err.Error()}
+	}
+	if t == nil || !t.Active {
+		return -1, fmt.Errorf("2FA not enabled")
+	}
+
+	return uid, nil
+}
+
+// Number of remaining recovery codes
+func (a *Auth) TOTPRecovery(in *TOTPRecoveryIn, out *TOTPRecoveryOut) error {
+	uid, err := a.get2FAUser(in.Token)
+	if err != nil {
+		return err
+	}
+
+	if out.Count, err = a.db.CountRecovery(uid); err != nil {
+		return &intErr{err.Error()}
+	}
+	return nil
+}
+
+// Replace the recovery codes; requires the password, as
+// a stolen session shouldn't be enough to bypass 2FA.
+func (a *Auth) TOTPRegen(in *TOTPRegenIn, out *TOTPRegenOut) error {
+	uid, err := a.get2FAUser(in.Token)
+	if err != nil {
+		return err
+	}
+
+	u := User{Id: uid}
+	if err := a.db.GetUser(&u); err != nil {
+		return err
+	}
+
+	if err := matchPasswd(&u, in.Passwd); err != nil {
+		return err
+	}
+
+	out.Codes, err = a.newRecoveryCodes(uid)
+	return err
+}
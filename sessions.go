@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+)
+
+// In-memory SessionStore: sessions are lost on restart.
+type MemSessions struct {
+	sync.Mutex
+
+	// uid -> sid -> session
+	xs map[UserId]map[string]Session
+
+	// hash -> refresh token
+	rs map[string]Refresh
+}
+
+func NewMemSessions() *MemSessions {
+	return &MemSessions{
+		xs: map[UserId]map[string]Session{},
+		rs: map[string]Refresh{},
+	}
+}
+
+func (m *MemSessions) SetSession(s *Session) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.xs[s.UId]; !ok {
+		m.xs[s.UId] = map[string]Session{}
+	}
+	m.xs[s.UId][s.Id] = *s
+	return nil
+}
+
+func (m *MemSessions) GetSession(uid UserId, sid string) (*Session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.xs[uid][sid]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *MemSessions) GetSessions(uid UserId) ([]Session, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	ss := []Session{}
+	for _, s := range m.xs[uid] {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].CDate == ss[j].CDate {
+			return ss[i].Id < ss[j].Id
+		}
+		return ss[i].CDate < ss[j].CDate
+	})
+	return ss, nil
+}
+
+func (m *MemSessions) RmSession(uid UserId, sid string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.xs[uid], sid)
+	m.rmRefreshes()
+	return nil
+}
+
+func (m *MemSessions) RmSessions(uid UserId) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.xs, uid)
+	m.rmRefreshes()
+	return nil
+}
+
+func (m *MemSessions) ExpireSessions(date int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for uid, ss := range m.xs {
+		for sid, s := range ss {
+			if s.EDate <= date {
+				delete(ss, sid)
+			}
+		}
+		if len(ss) == 0 {
+			delete(m.xs, uid)
+		}
+	}
+	m.rmRefreshes()
+	return nil
+}
+
+func (m *MemSessions) AddRefresh(r *Refresh) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.rs[r.Hash] = *r
+	return nil
+}
+
+func (m *MemSessions) UseRefresh(hash string) (*Refresh, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	r, ok := m.rs[hash]
+	if !ok {
+		return nil, nil
+	}
+	m.rs[hash] = Refresh{r.Hash, r.UId, r.SId, r.CDate, true}
+	return &r, nil
+}
+
+// Remove refresh tokens whose session is gone; m must be locked.
+func (m *MemSessions) rmRefreshes() {
+	for h, r := range m.rs {
+		if _, ok := m.xs[r.UId][r.SId]; !ok {
+			delete(m.rs, h)
+		}
+	}
+}
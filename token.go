@@ -3,170 +3,455 @@ package auth
 // Thin wrapper above https://github.com/golang-jwt/jwt
 // to isolate technical details.
 //
-// "Public" functions are the capitalized ones (NewToken(),
-// CheckToken(), ChainToken(), ClearUser())
+// "Public" methods are the capitalized ones (NewToken(),
+// CheckToken(), ChainToken(), EndSession(), ClearUser())
+//
+// Each NewToken() opens a new session, identified by a
+// random sid carried in the token; a user can thus have
+// multiple concurrent sessions (browsers, devices, etc.).
+// Within a session, the uniq is renewed each time the token
+// is chained, so that only the last chained token is valid.
 
 import (
+	"errors"
 	"fmt"
 	"time"
 	jwt "github.com/golang-jwt/jwt/v5"
-	"sync"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
 )
 
-var (
-	uniqs   = map[UserId]string{}
-	uniqsMu = &sync.Mutex{}
-)
-
-func newHMACToken(uid UserId, edate int64, uniq string) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"uid"  : uid,
-		"uniq" : uniq,
-		// XXX jwt.NewNumericDate(time.Now().Add(C.Timeout)) ?
-		"date" : edate,
-	}).SignedString([]byte(C.HMAC))
+// Registered claims (RFC 7519): the uid is the subject, the uniq
+// the token's id; the session id is kept as a private claim.
+func (a *Auth) mkClaims(uid UserId, sid string, edate int64, uniq string) jwt.MapClaims {
+	now := time.Now().Unix()
+	claims := jwt.MapClaims{
+		"sub"  : strconv.FormatInt(int64(uid), 10),
+		"sid"  : sid,
+		"jti"  : uniq,
+		"exp"  : edate,
+		"iat"  : now,
+		"nbf"  : now,
+	}
+	if a.c.Issuer != "" {
+		claims["iss"] = a.c.Issuer
+	}
+	if a.c.Audience != "" {
+		claims["aud"] = a.c.Audience
+	}
+	return claims
 }
 
-func newECDSAToken(uid UserId, edate int64, uniq string) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
-		"uid"  : uid,
-		"uniq" : uniq,
-		// XXX jwt.NewNumericDate(time.Now().Add(C.Timeout)) ?
-		"date" : edate,
-	}).SignedString(privateKey)
+func (a *Auth) signToken(claims jwt.MapClaims) (string, error) {
+	k := a.getKeys().cur
+	tok := jwt.NewWithClaims(k.method, claims)
+	tok.Header["kid"] = k.kid
+	return tok.SignedString(k.sign)
 }
 
 // NOTE: not inlined in NewToken for tests
-func newToken(uid UserId, edate int64, uniq string) (string, error) {
-	if C.HMAC != "" {
-		return newHMACToken(uid, edate, uniq)
+func (a *Auth) newToken(uid UserId, sid string, edate int64, uniq string) (string, error) {
+	return a.signToken(a.mkClaims(uid, sid, edate, uniq))
+}
+
+// Short-lived tokens of sessions opened with a refresh token;
+// those can't be chained (see RefreshToken()).
+func (a *Auth) newAccessToken(uid UserId, sid string, edate int64, uniq string) (string, error) {
+	claims := a.mkClaims(uid, sid, edate, uniq)
+	claims["refresh"] = true
+	return a.signToken(claims)
+}
+
+// Create or update the given session.
+func (a *Auth) storeSession(s *Session) error {
+	if err := a.sessions.SetSession(s); err != nil {
+		return &intErr{err.Error()}
 	}
-	return newECDSAToken(uid, edate, uniq)
+	return nil
 }
 
-func storeUniq(uid UserId, uniq string) string {
-	uniqsMu.Lock()
-	defer uniqsMu.Unlock()
-	uniqs[uid] = uniq
-	return uniq
+func (a *Auth) NewToken(uid UserId) (string, error) {
+	return a.newSessionToken(uid, "", "")
 }
 
-func mkUniq(uid UserId) string {
-	return storeUniq(uid, randString(C.LenUniq))
+// Open a new session for uid, from a client with the
+// given user agent and IP (informative).
+func (a *Auth) newSessionToken(uid UserId, ua, ip string) (string, error) {
+	s, err := a.openSession(uid, ua, ip, a.c.Timeout)
+	if err != nil {
+		return "", err
+	}
+	return a.newToken(uid, s.Id, s.EDate, s.Uniq)
 }
 
-func NewToken(uid UserId) (string, error) {
-	return newToken(uid, time.Now().Unix()+C.Timeout, mkUniq(uid))
+// Same as newSessionToken(), but the session lasts for
+// RefreshTimeout, and is extended through refresh tokens
+// (returned along with a short-lived token).
+func (a *Auth) newRefreshSession(uid UserId, ua, ip string) (string, string, error) {
+	if a.c.RefreshTimeout == 0 {
+		return "", "", fmt.Errorf("Refresh tokens disabled")
+	}
+
+	s, err := a.openSession(uid, ua, ip, a.c.RefreshTimeout)
+	if err != nil {
+		return "", "", err
+	}
+
+	rtok, err := a.addRefresh(uid, s.Id, s.CDate)
+	if err != nil {
+		return "", "", err
+	}
+
+	tok, err := a.newAccessToken(uid, s.Id, s.CDate+a.c.AccessTimeout, s.Uniq)
+	return tok, rtok, err
 }
 
-func parseHMAC(tok *jwt.Token) (any, error) {
-	if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("Invalid signing method: %v", tok.Header["alg"])
+func (a *Auth) openSession(uid UserId, ua, ip string, timeout int64) (*Session, error) {
+	now := time.Now().Unix()
+
+	sid, err := randString(a.c.LenUniq)
+	if err != nil {
+		return nil, err
+	}
+	uniq, err := randString(a.c.LenUniq)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Session{
+		UId   : uid,
+		Id    : sid,
+		Uniq  : uniq,
+		EDate : now+timeout,
+		CDate : now,
+		LDate : now,
+		UA    : ua,
+		IP    : ip,
+	}
+
+	// Good time to clean things up
+	if err := a.sessions.ExpireSessions(now); err != nil {
+		return nil, &intErr{err.Error()}
 	}
-	return []byte(C.HMAC), nil
+
+	if err := a.storeSession(&s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
 }
 
-func parseECDSA(tok *jwt.Token) (any, error) {
-	if _, ok := tok.Method.(*jwt.SigningMethodECDSA); !ok {
-		return nil, fmt.Errorf("Invalid signing method: %v", tok.Header["alg"])
+// Refresh tokens are opaque; only their hash is stored.
+func hashRefresh(rtok string) string {
+	h := sha256.Sum256([]byte(rtok))
+	return hex.EncodeToString(h[:])
+}
+
+// Issue a new refresh token for the given session
+func (a *Auth) addRefresh(uid UserId, sid string, now int64) (string, error) {
+	rtok, err := randString(a.c.LenUniq)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.sessions.AddRefresh(&Refresh{
+		Hash  : hashRefresh(rtok),
+		UId   : uid,
+		SId   : sid,
+		CDate : now,
+	})
+	if err != nil {
+		return "", &intErr{err.Error()}
 	}
-	return publicKey, nil
+	return rtok, nil
 }
 
-func ParseToken(str string) (jwt.MapClaims, error) {
-	tok, err := jwt.Parse(str, func(tok *jwt.Token) (any, error) {
-		if C.HMAC != ""{
-			return parseHMAC(tok)
+// Trade a refresh token for a new short-lived token and a new
+// refresh token; each refresh token can only be used once.
+func (a *Auth) RefreshToken(rtok string) (string, string, error) {
+	now := time.Now().Unix()
+
+	r, err := a.sessions.UseRefresh(hashRefresh(rtok))
+	if err != nil {
+		return "", "", &intErr{err.Error()}
+	}
+	if r == nil {
+		return "", "", &authErr{"Invalid refresh token"}
+	}
+
+	// Either stolen, or a buggy client: the whole
+	// family can't be trusted anymore.
+	if r.Used {
+		if err := a.sessions.RmSession(r.UId, r.SId); err != nil {
+			return "", "", &intErr{err.Error()}
 		}
-		return parseECDSA(tok)
-	})
+		return "", "", &authErr{"Refresh token reused"}
+	}
 
+	s, err := a.sessions.GetSession(r.UId, r.SId)
 	if err != nil {
-		return nil, err
+		return "", "", &intErr{err.Error()}
+	}
+	if s == nil || s.EDate <= now {
+		return "", "", &authErr{"Expired refresh token"}
+	}
+
+	// Previous short-lived token is invalidated
+	if s.Uniq, err = randString(a.c.LenUniq); err != nil {
+		return "", "", err
 	}
+	s.EDate = now+a.c.RefreshTimeout
+	s.LDate = now
 
-	if claims, ok := tok.Claims.(jwt.MapClaims); ok && tok.Valid {
-		return claims, nil
+	if err := a.storeSession(s); err != nil {
+		return "", "", err
 	}
 
-	return nil, fmt.Errorf("Invalid token (not a jwt.MapClaims?)")
+	if rtok, err = a.addRefresh(s.UId, s.Id, now); err != nil {
+		return "", "", err
+	}
+
+	tok, err := a.newAccessToken(s.UId, s.Id, now+a.c.AccessTimeout, s.Uniq)
+	return tok, rtok, err
 }
 
-func checkToken(claims jwt.MapClaims) bool {
-	uniqsMu.Lock()
-	defer uniqsMu.Unlock()
+// Select the verification key by kid; tokens without kid
+// (signed before kids were introduced) use the current key.
+// The algorithm is pinned by the key.
+func (a *Auth) keyFunc(tok *jwt.Token) (any, error) {
+	ks := a.getKeys()
+
+	k := ks.cur
+	if x, ok := tok.Header["kid"]; ok {
+		kid, _ := x.(string)
+		if k, ok = ks.keys[kid]; !ok {
+			return nil, fmt.Errorf("Unknown key id: %v", x)
+		}
+	}
 
+	if tok.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("Invalid signing method: %v", tok.Header["alg"])
+	}
+	return k.verify, nil
+}
+
+var errLegacy = fmt.Errorf("Legacy token format")
+var errRefreshable = fmt.Errorf("Token can't be chained (use /refresh)")
+
+// Old tokens (uid, uniq, date claims) have no "sub"
+func isLegacy(claims jwt.MapClaims) bool {
+	_, sub  := claims["sub"]
+	_, date := claims["date"]
+	return !sub && date
+}
+
+func (a *Auth) ParseToken(str string) (jwt.MapClaims, error) {
+	// Claims are validated below, depending on the token's format
+	tok, err := jwt.Parse(str, a.keyFunc, jwt.WithoutClaimsValidation(),
+		jwt.WithValidMethods(a.getKeys().algs()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok || !tok.Valid {
+		return nil, fmt.Errorf("Invalid token (not a jwt.MapClaims?)")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithLeeway(time.Duration(a.c.Leeway)*time.Second),
+	}
+
+	// NOTE: legacy tokens' expiration is checked by getSession()
+	if isLegacy(claims) {
+		if !a.c.LegacyTokens {
+			return nil, errLegacy
+		}
+	} else {
+		opts = append(opts, jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+		if a.c.Issuer != "" {
+			opts = append(opts, jwt.WithIssuer(a.c.Issuer))
+		}
+		if a.c.Audience != "" {
+			opts = append(opts, jwt.WithAudience(a.c.Audience))
+		}
+	}
+
+	// NOTE: same error as jwt.Parse() would have returned
+	if err := jwt.NewValidator(opts...).Validate(claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, err)
+	}
+
+	return claims, nil
+}
+
+// Retrieve the session associated to some (parsed) claims;
+// nil if there's none, or if the token is outdated.
+func (a *Auth) getSession(claims jwt.MapClaims) (*Session, error) {
 	// we're unpacking a (correctly) signed token: all
 	// those must be present (well, can't have been
 	// altered from outside at least).
 	//
 	// NOTE: we may still want to add assertions here anyway.
-	date, _ := claims["date"].(float64)
-	uniq, _ := claims["uniq"].(string)
-	xuid, _ := claims["uid"].(float64)
+	uid, sid := claimsSession(claims)
+	uniq, date := claimsUniq(claims)
 
-	uid := UserId(xuid)
+	dok := (date+a.c.Leeway > time.Now().Unix())
 
-	dok := (int64(date) > time.Now().Unix())
+	s, err := a.sessions.GetSession(uid, sid)
+	if err != nil {
+		return nil, &intErr{err.Error()}
+	}
+	if s == nil {
+		return nil, nil
+	}
 
 	// XXX/TODO
 	// I mean, sure, but if the token has been signed and we're assuming
 	// it hasn't been altered, the likelihood for this to be incorrect
 	// is zero: the whole uniq shebang feels overkill, especially
 	// with all that surrounding noise.
-	uok := subtle.ConstantTimeCompare([]byte(uniq), []byte(uniqs[uid])) == 1
+	uok := subtle.ConstantTimeCompare([]byte(uniq), []byte(s.Uniq)) == 1
+
+	if !dok || !uok {
+		return nil, nil
+	}
+
+	return s, nil
+}
 
-	return dok && uok
+func (a *Auth) checkToken(claims jwt.MapClaims) (bool, error) {
+	s, err := a.getSession(claims)
+	return s != nil, err
 }
 
-func CheckToken(str string) (bool, UserId, error) {
+// Parse a token and retrieve its session (nil if there's
+// none); "" is a valid (logged out) token.
+func (a *Auth) tokenSession(str string) (*Session, error) {
+	if str == "" {
+		return nil, nil
+	}
+	claims, err := a.ParseToken(str)
+	if err != nil {
+		return nil, err
+	}
+	return a.getSession(claims)
+}
+
+// Retrieve the session identifiers from (checked) claims
+func claimsSession(claims jwt.MapClaims) (UserId, string) {
+	sid, _ := claims["sid"].(string)
+	if isLegacy(claims) {
+		xuid, _ := claims["uid"].(float64)
+		return UserId(xuid), sid
+	}
+
+	sub, _ := claims["sub"].(string)
+	uid, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil {
+		return -1, sid
+	}
+	return UserId(uid), sid
+}
+
+// Retrieve the uniq and expiration date from (checked) claims
+func claimsUniq(claims jwt.MapClaims) (string, int64) {
+	if isLegacy(claims) {
+		uniq, _ := claims["uniq"].(string)
+		date, _ := claims["date"].(float64)
+		return uniq, int64(date)
+	}
+	uniq, _ := claims["jti"].(string)
+	date, _ := claims["exp"].(float64)
+	return uniq, int64(date)
+}
+
+func (a *Auth) CheckToken(str string) (bool, UserId, error) {
 	// TODO: test & document (essentially, we're going to
 	// rely on a HTTP cookie to store the token, and the way
 	// it's removed is by setting it to the empty string)
 	if str == "" {
 		return false, -1, nil
 	}
-	claims, err := ParseToken(str)
+	claims, err := a.ParseToken(str)
+
+	// Those are just outdated sessions
+	if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, errLegacy) {
+		return false, -1, nil
+	}
 	if err != nil {
 		return false, -1, err
 	}
 
-	xuid, _ := claims["uid"].(float64)
-	uid := UserId(xuid)
+	uid, _ := claimsSession(claims)
 
-	return checkToken(claims), uid, nil
+	ok, err := a.checkToken(claims)
+	return ok, uid, err
 }
 
 // NOTE: Again, not inlined in ChainToken() for tests
-func chainToken(str string, edate int64, uniq string) (string, error) {
-	claims, err := ParseToken(str)
+func (a *Auth) chainToken(str string, edate int64, uniq string) (string, error) {
+	claims, err := a.ParseToken(str)
 	if err != nil {
 		return "", err
 	}
 
-	if !checkToken(claims) {
+	s, err := a.getSession(claims)
+	if err != nil {
+		return "", err
+	} else if s == nil {
 		return "", fmt.Errorf("Expired token")
 	}
 
-	xuid, _ := claims["uid"].(float64)
-	uid := UserId(xuid)
+	if r, _ := claims["refresh"].(bool); r {
+		return "", errRefreshable
+	}
 
-	// In tests, we provide a known uniq; it's "" iff we're
+	// In tests, we provide a known uniq; it's "" iff we're
 	// in production (see ChainToken() below)
 	if uniq == "" {
-		uniq = mkUniq(uid)
+		if uniq, err = randString(a.c.LenUniq); err != nil {
+			return "", err
+		}
+	}
+
+	s.Uniq  = uniq
+	s.EDate = edate
+	s.LDate = time.Now().Unix()
+
+	if err := a.storeSession(s); err != nil {
+		return "", err
 	}
 
-	return newToken(uid, edate, uniq)
+	return a.newToken(s.UId, s.Id, edate, uniq)
 }
 
-func ChainToken(str string) (string, error) {
-	return chainToken(str, time.Now().Unix()+C.Timeout, "")
+func (a *Auth) ChainToken(str string) (string, error) {
+	return a.chainToken(str, time.Now().Unix()+a.c.Timeout, "")
 }
 
-func ClearUser(uid UserId) {
-	uniqsMu.Lock()
-	defer uniqsMu.Unlock()
-	delete(uniqs, uid)
+// Close the session associated to the given (valid) token.
+func (a *Auth) EndSession(str string) error {
+	s, err := a.tokenSession(str)
+	if err != nil {
+		return err
+	} else if s == nil {
+		return fmt.Errorf("Expired token")
+	}
+
+	if err := a.sessions.RmSession(s.UId, s.Id); err != nil {
+		return &intErr{err.Error()}
+	}
+	return nil
+}
+
+// Close all uid's a.sessions.
+func (a *Auth) ClearUser(uid UserId) error {
+	if err := a.sessions.RmSessions(uid); err != nil {
+		return &intErr{err.Error()}
+	}
+	return nil
 }
@@ -11,26 +11,50 @@ import (
 	"testing"
 	"time"
 	"log"
+	"fmt"
+	"os"
+	"syscall"
+	"path/filepath"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/mbivert/ftests"
 )
 
+var tauth *Auth
+
 func init() {
-	if err := LoadConf("config.json.base"); err != nil {
+	c, err := ReadConf("config.json.base")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tauth, err = NewAuth(c, nil); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func newParseToken(uid UserId, date int64, uniq string) jwt.MapClaims {
-	str, err := newToken(uid, date, uniq)
+// iat/nbf are set to the current time
+func redactNow(claims jwt.MapClaims) jwt.MapClaims {
+	if claims != nil {
+		claims["iat"] = 0
+		claims["nbf"] = 0
+	}
+	return claims
+}
+
+func newParseToken(uid UserId, sid string, date int64, uniq string) jwt.MapClaims {
+	str, err := tauth.newToken(uid, sid, date, uniq)
 	if err != nil {
 		log.Fatal(err)
 	}
-	claims, err := ParseToken(str)
+	claims, err := tauth.ParseToken(str)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return claims
+	return redactNow(claims)
 }
 
 func TestNewParseToken(t *testing.T) {
@@ -40,56 +64,682 @@ func TestNewParseToken(t *testing.T) {
 		{
 			"token creation",
 			newParseToken,
-			[]any{UserId(42), date, "one-time-value"},
+			[]any{UserId(42), "session-id", date, "one-time-value"},
 			[]any{jwt.MapClaims{
-				"uid"  : float64(42),
-				"uniq" : "one-time-value",
-				"date" : float64(date),
+				"sub"  : "42",
+				"sid"  : "session-id",
+				"jti"  : "one-time-value",
+				"exp"  : float64(date),
+				"iat"  : 0,
+				"nbf"  : 0,
 			}},
 		},
 	})
 }
 
 func newChainParseToken(
-	uid UserId, before, after int64, uniq, uniq2 string,
+	uid UserId, sid string, before, after int64, uniq, uniq2 string,
 ) jwt.MapClaims {
-	storeUniq(uid, uniq)
-	str, err := newToken(uid, before, uniq)
+	err := tauth.storeSession(&Session{UId: uid, Id: sid, Uniq: uniq, EDate: before})
+	if err != nil {
+		log.Fatal(err)
+	}
+	str, err := tauth.newToken(uid, sid, before, uniq)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	str2, err := chainToken(str, after, uniq2)
+	str2, err := tauth.chainToken(str, after, uniq2)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	claims, err := ParseToken(str2)
+	claims, err := tauth.ParseToken(str2)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return claims
+	return redactNow(claims)
 }
 
 func TestCheckToken(t *testing.T) {
-	before := time.Now().Unix() + C.Timeout
-	after  := time.Now().Unix() + 2*C.Timeout
+	before := time.Now().Unix() + tauth.c.Timeout
+	after  := time.Now().Unix() + 2*tauth.c.Timeout
 
 	ftests.Run(t, []ftests.Test{
 		{
 			"basic token chaining",
 			newChainParseToken,
 			[]any{
-				UserId(42), before, after,
+				UserId(42), "session-id", before, after,
 				"one-time-value",
 				"another-one-time-value",
 			},
 			[]any{jwt.MapClaims{
-				"uid"  : float64(42),
-				"uniq" : "another-one-time-value",
-				"date" : float64(after),
+				"sub"  : "42",
+				"sid"  : "session-id",
+				"jti"  : "another-one-time-value",
+				"exp"  : float64(after),
+				"iat"  : 0,
+				"nbf"  : 0,
+			}},
+		},
+	})
+}
+
+// Sign arbitrary claims with tauth's key, and parse them
+// back with a tweaked configuration.
+func parseClaims(claims jwt.MapClaims, f func(*Config)) string {
+	str, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(tauth.c.HMAC))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := tauth.c
+	f(&c)
+	a, err := NewAuth(&c, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err = a.ParseToken(str); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestRegisteredClaims(t *testing.T) {
+	now := time.Now().Unix()
+	nop := func(*Config) {}
+
+	claims := func(xs map[string]any) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub" : "42",
+			"sid" : "session-id",
+			"jti" : "one-time-value",
+			"exp" : now+60,
+			"iat" : now,
+			"nbf" : now,
+		}
+		for k, v := range xs {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	legacy := jwt.MapClaims{
+		"uid"  : 42,
+		"sid"  : "session-id",
+		"uniq" : "one-time-value",
+		"date" : now+60,
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Valid claims",
+			parseClaims,
+			[]any{claims(nil), nop},
+			[]any{""},
+		},
+		{
+			"exp is required",
+			parseClaims,
+			[]any{claims(map[string]any{"exp" : nil}), nop},
+			[]any{jwt.ErrTokenInvalidClaims.Error()+": "+jwt.ErrTokenRequiredClaimMissing.Error()+": exp claim is required"},
+		},
+		{
+			"Expired",
+			parseClaims,
+			[]any{claims(map[string]any{"exp" : now-60}), nop},
+			[]any{jwt.ErrTokenInvalidClaims.Error()+": "+jwt.ErrTokenExpired.Error()},
+		},
+		{
+			"Expired, within leeway",
+			parseClaims,
+			[]any{claims(map[string]any{"exp" : now-60}), func(c *Config) {
+				c.Leeway = 120
+			}},
+			[]any{""},
+		},
+		{
+			"Not yet valid",
+			parseClaims,
+			[]any{claims(map[string]any{"nbf" : now+60}), func(c *Config) {
+				c.Leeway = 0
+			}},
+			[]any{jwt.ErrTokenInvalidClaims.Error()+": "+jwt.ErrTokenNotValidYet.Error()},
+		},
+		{
+			"Issued in the future, within leeway",
+			parseClaims,
+			[]any{claims(map[string]any{"iat" : now+10}), func(c *Config) {
+				c.Leeway = 30
+			}},
+			[]any{""},
+		},
+		{
+			"Issuer & audience",
+			parseClaims,
+			[]any{claims(map[string]any{"iss" : "auth", "aud" : "api"}), func(c *Config) {
+				c.Issuer   = "auth"
+				c.Audience = "api"
+			}},
+			[]any{""},
+		},
+		{
+			"Wrong issuer",
+			parseClaims,
+			[]any{claims(map[string]any{"iss" : "other"}), func(c *Config) {
+				c.Issuer   = "auth"
+			}},
+			[]any{jwt.ErrTokenInvalidClaims.Error()+": "+jwt.ErrTokenInvalidIssuer.Error()},
+		},
+		{
+			"Missing audience",
+			parseClaims,
+			[]any{claims(nil), func(c *Config) {
+				c.Audience = "api"
+			}},
+			[]any{jwt.ErrTokenInvalidClaims.Error()+": "+jwt.ErrTokenRequiredClaimMissing.Error()+": aud claim is required"},
+		},
+		{
+			"Legacy token, rejected",
+			parseClaims,
+			[]any{legacy, nop},
+			[]any{"Legacy token format"},
+		},
+		{
+			"Legacy token, migration window",
+			parseClaims,
+			[]any{legacy, func(c *Config) {
+				c.LegacyTokens = true
+			}},
+			[]any{""},
+		},
+	})
+}
+
+func TestLegacySession(t *testing.T) {
+	c := tauth.c
+	c.LegacyTokens = true
+	a, err := NewAuth(&c, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	edate := time.Now().Unix()+60
+	if err := a.storeSession(&Session{UId: 42, Id: "sid", Uniq: "uniq", EDate: edate}); err != nil {
+		log.Fatal(err)
+	}
+
+	legacy := func(date int64) string {
+		str, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"uid"  : 42,
+			"sid"  : "sid",
+			"uniq" : "uniq",
+			"date" : date,
+		}).SignedString([]byte(c.HMAC))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return str
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Valid legacy token",
+			a.CheckToken,
+			[]any{legacy(edate)},
+			[]any{true, UserId(42), nil},
+		},
+		{
+			"Expired legacy token",
+			a.CheckToken,
+			[]any{legacy(edate-3600)},
+			[]any{false, UserId(42), nil},
+		},
+		{
+			"Legacy token, after the migration window",
+			tauth.CheckToken,
+			[]any{legacy(edate)},
+			[]any{false, UserId(-1), nil},
+		},
+	})
+}
+
+// Write a fresh ECDSA private key to fn
+func writeECKey(fn string) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	xs, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: xs}), 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func mustAuth(c Config) *Auth {
+	a, err := NewAuth(&c, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+// Token for a new session on a
+func mustToken(a *Auth) string {
+	tok, err := a.NewToken(42)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tok
+}
+
+// ParseToken() error ("" if none)
+func parseErr(a *Auth, tok string) string {
+	if _, err := a.ParseToken(tok); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func jwksLen(a *Auth) int {
+	return len(a.JWKS().Keys)
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	cur := filepath.Join(dir, "current.pem")
+	old := filepath.Join(dir, "old", "key.pem")
+	if err := os.Mkdir(filepath.Dir(old), 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	writeECKey(cur)
+
+	c := tauth.c
+	c.PrivateKey = cur
+	c.PublicKey  = ""
+	c.KeyDir     = filepath.Dir(old)
+
+	a := mustAuth(c)
+	tok0 := mustToken(a)
+	kid0 := a.getKeys().cur.kid
+
+	// Rotation: current key moved to the verification keys
+	if err := os.Rename(cur, old); err != nil {
+		log.Fatal(err)
+	}
+	writeECKey(cur)
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Token signed by the current key",
+			parseErr,
+			[]any{a, tok0},
+			[]any{""},
+		},
+		{
+			"Reload",
+			a.ReloadKeys,
+			[]any{&c},
+			[]any{nil},
+		},
+		{
+			"Old token still accepted",
+			parseErr,
+			[]any{a, tok0},
+			[]any{""},
+		},
+		{
+			"Both keys published",
+			jwksLen,
+			[]any{a},
+			[]any{2},
+		},
+		{
+			"New tokens signed by the new key",
+			func() bool {
+				tok, _, err := jwt.NewParser().ParseUnverified(mustToken(a), jwt.MapClaims{})
+				return err == nil && tok.Header["kid"] == a.getKeys().cur.kid &&
+					tok.Header["kid"] != kid0
+			},
+			[]any{},
+			[]any{true},
+		},
+	})
+
+	// Old key eventually retired
+	if err := os.Remove(old); err != nil {
+		log.Fatal(err)
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Reload",
+			a.ReloadKeys,
+			[]any{&c},
+			[]any{nil},
+		},
+		{
+			"Old token rejected",
+			parseErr,
+			[]any{a, tok0},
+			[]any{jwt.ErrTokenUnverifiable.Error()+": error while executing keyfunc: Unknown key id: "+kid0},
+		},
+		{
+			"Only the current key is published",
+			jwksLen,
+			[]any{a},
+			[]any{1},
+		},
+	})
+
+	// Broken key: reload fails, current set is kept
+	if err := os.WriteFile(old, []byte("garbage"), 0600); err != nil {
+		log.Fatal(err)
+	}
+	tok1 := mustToken(a)
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Failed reload",
+			func() bool { return a.ReloadKeys(&c) != nil },
+			[]any{},
+			[]any{true},
+		},
+		{
+			"Keys kept",
+			parseErr,
+			[]any{a, tok1},
+			[]any{""},
+		},
+	})
+}
+
+func TestHMACRotation(t *testing.T) {
+	c0 := tauth.c
+	c0.HMAC = "old-secret"
+
+	c1 := tauth.c
+	c1.HMAC     = "new-secret"
+	c1.OldHMACs = []string{"old-secret"}
+
+	tok0 := mustToken(mustAuth(c0))
+	a1 := mustAuth(c1)
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Token signed with an old secret",
+			parseErr,
+			[]any{a1, tok0},
+			[]any{""},
+		},
+		{
+			"Token signed with the current secret",
+			parseErr,
+			[]any{a1, mustToken(a1)},
+			[]any{""},
+		},
+		{
+			"Old secret retired",
+			parseErr,
+			[]any{tauth, tok0},
+			[]any{jwt.ErrTokenUnverifiable.Error()+": error while executing keyfunc: Unknown key id: "+hmacKey("old-secret").kid},
+		},
+		{
+			"No HMAC published",
+			jwksLen,
+			[]any{a1},
+			[]any{0},
+		},
+	})
+
+	// Same rotation, on a running service
+	a := mustAuth(c0)
+	bad := c1
+	bad.HMAC = ""
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Invalid configuration rejected",
+			a.ReloadKeys,
+			[]any{&bad},
+			[]any{fmt.Errorf("At least a HMAC or a PrivateKey must be specified")},
+		},
+		{
+			"Keys kept",
+			func() string { return a.getKeys().cur.kid },
+			[]any{},
+			[]any{hmacKey("old-secret").kid},
+		},
+		{
+			"Reload from the new configuration",
+			a.ReloadKeys,
+			[]any{&c1},
+			[]any{nil},
+		},
+		{
+			"Token signed with the old secret still accepted",
+			parseErr,
+			[]any{a, tok0},
+			[]any{""},
+		},
+		{
+			"New secret used to sign",
+			func() string { return a.getKeys().cur.kid },
+			[]any{},
+			[]any{hmacKey("new-secret").kid},
+		},
+	})
+}
+
+func TestReloadKeysOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	cur := filepath.Join(dir, "current.pem")
+	writeECKey(cur)
+
+	c := tauth.c
+	c.PrivateKey = cur
+	a := mustAuth(c)
+	kid0 := a.getKeys().cur.kid
+
+	stop := a.ReloadKeysOnSignal(func() (*Config, error) {
+		c := c
+		return &c, nil
+	}, syscall.SIGUSR1)
+	defer stop()
+
+	writeECKey(cur)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		log.Fatal(err)
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Keys reloaded on signal",
+			func() bool {
+				for i := 0; i < 100; i++ {
+					if a.getKeys().cur.kid != kid0 {
+						return true
+					}
+					time.Sleep(10*time.Millisecond)
+				}
+				return false
+			},
+			[]any{},
+			[]any{true},
+		},
+	})
+}
+
+// Write a GenKey() pair for alg in dir; returns the file names
+func writeKeys(dir, alg string) (string, string) {
+	xs, ys, err := GenKey(alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	priv := filepath.Join(dir, alg+".pem")
+	pub  := filepath.Join(dir, alg+".pub")
+	if err := os.WriteFile(priv, xs, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(pub, ys, 0600); err != nil {
+		log.Fatal(err)
+	}
+	return priv, pub
+}
+
+// Sign a token with alg, and parse it back: header's alg,
+// ParseToken() error, published JWK's alg
+func algRoundTrip(dir, alg string) (any, string, string) {
+	priv, pub := writeKeys(dir, alg)
+
+	c := tauth.c
+	c.Alg        = alg
+	c.PrivateKey = priv
+	c.PublicKey  = pub
+	a := mustAuth(c)
+
+	tok := mustToken(a)
+	x, _, err := jwt.NewParser().ParseUnverified(tok, jwt.MapClaims{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ks := a.JWKS()
+	if len(ks.Keys) != 1 || ks.Keys[0].Kid != x.Header["kid"] {
+		log.Fatal("Unexpected JWKS")
+	}
+
+	return x.Header["alg"], parseErr(a, tok), ks.Keys[0].Alg
+}
+
+func TestAlgs(t *testing.T) {
+	dir := t.TempDir()
+
+	edPriv, edPub := writeKeys(dir, "EdDSA")
+	rsaPriv, _    := writeKeys(dir, "PS256")
+
+	cfgErr := func(f func(*Config)) string {
+		c := tauth.c
+		f(&c)
+		if _, err := NewAuth(&c, nil); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	// Classic confusion: public key used as a HMAC secret
+	confused := func() string {
+		c := tauth.c
+		c.Alg        = "EdDSA"
+		c.PrivateKey = edPriv
+		a := mustAuth(c)
+
+		xs, err := os.ReadFile(edPub)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub" : "42",
+			"exp" : time.Now().Unix()+60,
+		})
+		tok.Header["kid"] = a.getKeys().cur.kid
+		str, err := tok.SignedString(xs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return parseErr(a, str)
+	}
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"ES256",
+			algRoundTrip,
+			[]any{dir, "ES256"},
+			[]any{"ES256", "", "ES256"},
+		},
+		{
+			"EdDSA",
+			algRoundTrip,
+			[]any{dir, "EdDSA"},
+			[]any{"EdDSA", "", "EdDSA"},
+		},
+		{
+			"RS256",
+			algRoundTrip,
+			[]any{dir, "RS256"},
+			[]any{"RS256", "", "RS256"},
+		},
+		{
+			"PS256",
+			algRoundTrip,
+			[]any{dir, "PS256"},
+			[]any{"PS256", "", "PS256"},
+		},
+		{
+			"Algorithm confusion",
+			confused,
+			[]any{},
+			[]any{jwt.ErrTokenSignatureInvalid.Error()+": signing method HS256 is invalid"},
+		},
+		{
+			"Unknown algorithm",
+			cfgErr,
+			[]any{func(c *Config) { c.Alg = "none" }},
+			[]any{"Unknown Alg: 'none'"},
+		},
+		{
+			"Asymmetric algorithm without key",
+			cfgErr,
+			[]any{func(c *Config) { c.Alg = "RS256" }},
+			[]any{"RS256 requires a PrivateKey"},
+		},
+		{
+			"Key type mismatch",
+			cfgErr,
+			[]any{func(c *Config) {
+				c.Alg        = "ES256"
+				c.PrivateKey = edPriv
 			}},
+			[]any{"Key type doesn't fit ES256"},
+		},
+		{
+			"Mismatching public key",
+			cfgErr,
+			[]any{func(c *Config) {
+				c.Alg        = "PS256"
+				c.PrivateKey = rsaPriv
+				c.PublicKey  = edPub
+			}},
+			[]any{"Public key doesn't match private key"},
+		},
+		{
+			"Mixed key set",
+			cfgErr,
+			[]any{func(c *Config) {
+				c.Alg        = "EdDSA"
+				c.PrivateKey = edPriv
+				c.VerifyKeys = []string{rsaPriv}
+			}},
+			[]any{""},
+		},
+		{
+			"No key generation for HMAC",
+			func() string { _, _, err := GenKey("HS256"); return err.Error() },
+			[]any{},
+			[]any{"Cannot generate keys for 'HS256'"},
 		},
 	})
 }
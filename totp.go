@@ -0,0 +1,311 @@
+package auth
+
+// TOTP (RFC 6238) second factor: once enrolled (/2fa/enroll,
+// /2fa/confirm), /login no longer opens a session, but returns
+// a short-lived challenge, to be traded with a code on /2fa/login.
+//
+// Secrets are encrypted (AES-GCM, Config.TOTPKey) in the DB;
+// codes are the usual ones (SHA-1, 6 digits, 30s steps).
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	totpStep   = 30
+	totpDigits = 6
+	totpSkew   = 1 // accepted steps before/after the current one
+	totpLen    = 20
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Code for the given time step (RFC 4226's HOTP)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	off := sum[len(sum)-1] & 0xf
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// Time step matching code, or -1
+func totpCheck(secret []byte, code string, now time.Time) int64 {
+	t := now.Unix()/totpStep
+	for s := t-totpSkew; s <= t+totpSkew; s++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, s)), []byte(code)) == 1 {
+			return s
+		}
+	}
+	return -1
+}
+
+// Authenticator apps' enrollment URI (usually, as a QR code)
+func totpURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", b32.EncodeToString(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpStep))
+
+	u := url.URL{
+		Scheme   : "otpauth",
+		Host     : "totp",
+		Path     : "/"+issuer+":"+account,
+		RawQuery : q.Encode(),
+	}
+	return u.String()
+}
+
+// AES-GCM from the configured TOTPKey; nil if there's none.
+func (c *Config) totpAEAD() (cipher.AEAD, error) {
+	if c.TOTPKey == "" {
+		return nil, nil
+	}
+
+	k, err := base64.StdEncoding.DecodeString(c.TOTPKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TOTPKey: %s", err)
+	}
+
+	b, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TOTPKey: %s", err)
+	}
+
+	return cipher.NewGCM(b)
+}
+
+// Secrets are bound to their user, so that they can't
+// be moved around in the DB.
+func totpAD(uid UserId) []byte {
+	return []byte("totp:"+strconv.FormatInt(int64(uid), 10))
+}
+
+func (a *Auth) sealTOTP(uid UserId, secret []byte) (string, error) {
+	if a.totp == nil {
+		return "", &intErr{"2FA unavailable (TOTPKey)"}
+	}
+
+	nonce := make([]byte, a.totp.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", &intErr{err.Error()}
+	}
+
+	xs := a.totp.Seal(nonce, nonce, secret, totpAD(uid))
+	return base64.StdEncoding.EncodeToString(xs), nil
+}
+
+func (a *Auth) openTOTP(uid UserId, s string) ([]byte, error) {
+	if a.totp == nil {
+		return nil, &intErr{"2FA unavailable (TOTPKey)"}
+	}
+
+	xs, err := base64.StdEncoding.DecodeString(s)
+	n := a.totp.NonceSize()
+	if err != nil || len(xs) < n {
+		return nil, &intErr{"Corrupted TOTP secret"}
+	}
+
+	secret, err := a.totp.Open(nil, xs[:n], xs[n:], totpAD(uid))
+	if err != nil {
+		return nil, &intErr{"Cannot decrypt TOTP secret"}
+	}
+	return secret, nil
+}
+
+// uid's TOTP secret, if enrolled
+func (a *Auth) getTOTP(uid UserId) (*TOTP, []byte, error) {
+	t, err := a.db.GetTOTP(uid)
+	if err != nil {
+		return nil, nil, &intErr{err.Error()}
+	}
+	if t == nil {
+		return nil, nil, nil
+	}
+
+	secret, err := a.openTOTP(uid, t.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, secret, nil
+}
+
+// Create a challenge for uid, to be completed on /2fa/login
+func (a *Auth) mkChallenge(uid UserId) (string, error) {
+	tok, err := randString(a.c.LenUniq)
+	if err != nil {
+		return "", err
+	}
+	if err := a.db.AddChallenge(tok, uid, time.Now().Unix()); err != nil {
+		return "", &intErr{err.Error()}
+	}
+	return tok, nil
+}
+
+// Start (or restart) an enrollment; the secret isn't
+// used until confirmed. Requires the password, as for
+// TOTPRegen().
+func (a *Auth) TOTPEnroll(in *TOTPEnrollIn, out *TOTPEnrollOut) error {
+	if a.totp == nil {
+		return fmt.Errorf("2FA unavailable")
+	}
+
+	ok, uid, err := a.CheckToken(in.Token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Not connected!")
+	}
+
+	u := User{Id: uid}
+	if err := a.db.GetUser(&u); err != nil {
+		return err
+	}
+
+	if err := matchPasswd(&u, in.Passwd); err != nil {
+		return err
+	}
+
+	t, err := a.db.GetTOTP(uid)
+	if err != nil {
+		return &intErr{err.Error()}
+	}
+	if t != nil && t.Active {
+		return fmt.Errorf("2FA already enabled")
+	}
+
+	secret := make([]byte, totpLen)
+	if _, err := rand.Read(secret); err != nil {
+		return &intErr{err.Error()}
+	}
+
+	s, err := a.sealTOTP(uid, secret)
+	if err != nil {
+		return err
+	}
+
+	if err := a.db.SetTOTP(&TOTP{UId: uid, Secret: s}); err != nil {
+		return &intErr{err.Error()}
+	}
+
+	out.Secret = b32.EncodeToString(secret)
+	out.URI    = totpURI(a.c.TOTPIssuer, u.Name, secret)
+
+	return nil
+}
+
+// Activate the pending secret, provided a valid code
+func (a *Auth) TOTPConfirm(in *TOTPConfirmIn, out *TOTPConfirmOut) error {
+	ok, uid, err := a.CheckToken(in.Token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Not connected!")
+	}
+
+	t, secret, err := a.getTOTP(uid)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.Active {
+		return fmt.Errorf("No pending 2FA enrollment")
+	}
+
+	step := totpCheck(secret, in.Code, time.Now())
+	if step < 0 {
+		return fmt.Errorf("Invalid code")
+	}
+
+	// Codes first: 2FA mustn't be enabled without them
+	if out.Codes, err = a.newRecoveryCodes(uid); err != nil {
+		return err
+	}
+
+	t.Active = true
+	t.Last   = step
+	if err := a.db.SetTOTP(t); err != nil {
+		return &intErr{err.Error()}
+	}
+	return nil
+}
+
+// Second half of a /login: trade a challenge and a code (or
+// a recovery code) for a session. Challenges are single-use,
+// and wrong codes count as failed logins (lockout).
+func (a *Auth) TOTPLogin(in *TOTPLoginIn, out *LoginOut) error {
+	uid, err := tryTok(a.db.PopChallenge, in.Challenge, a.c.ChallengeTimeout)
+	if err != nil {
+		return err
+	}
+
+	t, secret, err := a.getTOTP(uid)
+	if err != nil {
+		return err
+	}
+	if t == nil || !t.Active {
+		return fmt.Errorf("Invalid token")
+	}
+
+	u := User{Id: uid}
+	if err := a.db.GetUser(&u); err != nil {
+		return err
+	}
+
+	// The account may have been locked since the challenge
+	// was issued (e.g. concurrent challenges).
+	now := time.Now()
+	if a.c.LockFails > 0 && u.LockUntil > now.Unix() {
+		return fmt.Errorf("Invalid code")
+	}
+
+	step := totpCheck(secret, in.Code, now)
+
+	// Codes can't be replayed
+	if step >= 0 {
+		ok, err := a.db.UseTOTP(uid, step)
+		if err != nil {
+			return &intErr{err.Error()}
+		}
+		if !ok {
+			step = -1
+		}
+	}
+
+	ok := step >= 0
+	if !ok {
+		if ok, err = a.useRecoveryCode(uid, in.Code); err != nil {
+			return err
+		}
+	}
+
+	if !ok {
+		if err := a.failedLogin(&u, now.Unix()); err != nil {
+			return err
+		}
+		return fmt.Errorf("Invalid code")
+	}
+
+	return a.openLogin(&u, in.Refresh, in.UA, in.IP, out)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/mbivert/ftests"
+)
+
+// RFC 6238, appendix B (SHA-1); only the last 6 digits
+var rfcSecret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	code := func(t int64) string { return totpCode(rfcSecret, t/totpStep) }
+
+	ftests.Run(t, []ftests.Test{
+		{"59",          code, []any{int64(59)},          []any{"287082"}},
+		{"1111111109",  code, []any{int64(1111111109)},  []any{"081804"}},
+		{"1111111111",  code, []any{int64(1111111111)},  []any{"050471"}},
+		{"1234567890",  code, []any{int64(1234567890)},  []any{"005924"}},
+		{"2000000000",  code, []any{int64(2000000000)},  []any{"279037"}},
+		{"20000000000", code, []any{int64(20000000000)}, []any{"353130"}},
+	})
+}
+
+func TestTOTPCheck(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix()/totpStep
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Current code",
+			totpCheck,
+			[]any{rfcSecret, "050471", now},
+			[]any{step},
+		},
+		{
+			"Previous code",
+			totpCheck,
+			[]any{rfcSecret, totpCode(rfcSecret, step-1), now},
+			[]any{step-1},
+		},
+		{
+			"Next code",
+			totpCheck,
+			[]any{rfcSecret, totpCode(rfcSecret, step+1), now},
+			[]any{step+1},
+		},
+		{
+			"Too old",
+			totpCheck,
+			[]any{rfcSecret, totpCode(rfcSecret, step-2), now},
+			[]any{int64(-1)},
+		},
+		{
+			"Garbage",
+			totpCheck,
+			[]any{rfcSecret, "", now},
+			[]any{int64(-1)},
+		},
+	})
+}
+
+func TestTOTPURI(t *testing.T) {
+	ftests.Run(t, []ftests.Test{
+		{
+			"Basic URI",
+			totpURI,
+			[]any{"My App", "test", rfcSecret},
+			[]any{"otpauth://totp/My%20App:test?algorithm=SHA1&digits=6" +
+				"&issuer=My+App&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"},
+		},
+	})
+}
+
+// Encrypt for uid, decrypt for uid2
+func sealOpen(key string, uid, uid2 UserId) (string, error) {
+	c := Config{TOTPKey: key}
+	aead, err := c.totpAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	a := &Auth{totp: aead}
+	s, err := a.sealTOTP(uid, rfcSecret)
+	if err != nil {
+		return "", err
+	}
+	xs, err := a.openTOTP(uid2, s)
+	return string(xs), err
+}
+
+func TestTOTPSecrets(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Round trip",
+			sealOpen,
+			[]any{key, UserId(1), UserId(1)},
+			[]any{string(rfcSecret), nil},
+		},
+		{
+			"Secrets are bound to their user",
+			sealOpen,
+			[]any{key, UserId(1), UserId(2)},
+			[]any{"", &intErr{"Cannot decrypt TOTP secret"}},
+		},
+		{
+			"No key",
+			sealOpen,
+			[]any{"", UserId(1), UserId(1)},
+			[]any{"", &intErr{"2FA unavailable (TOTPKey)"}},
+		},
+		{
+			"Invalid key size",
+			func() string {
+				c := Config{TOTPKey: base64.StdEncoding.EncodeToString(make([]byte, 7))}
+				_, err := c.totpAEAD()
+				return err.Error()
+			},
+			[]any{},
+			[]any{"Invalid TOTPKey: crypto/aes: invalid key size 7"},
+		},
+	})
+}
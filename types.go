@@ -1,16 +1,128 @@
 package auth
 
+import (
+	"errors"
+)
+
 // The UserId is assumed to be immutable for any user
 // (not like e.g. a username or an email)
 type UserId int64
 
+// Errors DB implementations are expected to return (possibly
+// wrapped), so that callers can tell them apart.
+var (
+	ErrNoUser    = errors.New("Invalid username or email")
+	ErrNameUsed  = errors.New("Username already used")
+	ErrEmailUsed = errors.New("Email already used")
+)
+
 // implemented by sqlite/main.go; used at least for tests
 type DB interface {
+	// ErrNameUsed/ErrEmailUsed if the name/email are taken
 	AddUser(*User) error
 	VerifyUser(UserId) error // verified email ownership
+
+	// Fetch an user by Id if non-zero, by Name or Email otherwise;
+	// ErrNoUser if there's no such user.
 	GetUser(*User) error
 	RmUser(UserId) (string, error)
-	EditUser() error
+
+	// Overwrite Name, Email, Passwd and Verified of the given
+	// user with the ones from the *User (Id/CDate are ignored).
+	EditUser(UserId, *User) error
+
+	// Overwrite the user's Fails and LockUntil
+	SetLock(UserId, int, int64) error
+
+	// Atomically increment the user's Fails, returning the
+	// new value; lock the user until the given date (a later
+	// existing lock is kept).
+	AddFail(UserId) (int, error)
+	LockUser(UserId, int64) error
+
+	// TOTP secrets: create/overwrite, fetch (nil, nil if
+	// there's none), and record a time step as used (false
+	// if it, or a later one, already was).
+	SetTOTP(*TOTP) error
+	GetTOTP(UserId) (*TOTP, error)
+	UseTOTP(UserId, int64) (bool, error)
+
+	// Recovery codes, by hash: replace all of the user's,
+	// consume one (false if there's no such code), count.
+	SetRecovery(UserId, []string) error
+	UseRecovery(UserId, string) (bool, error)
+	CountRecovery(UserId) (int, error)
+
+	// Second factor challenges (see Login()); same
+	// semantic as AddVerif()/PopVerif().
+	AddChallenge(string, UserId, int64) error
+	PopChallenge(string) (UserId, int64, error)
+
+	// Email verification tokens, with their creation date;
+	// PopVerif() removes the token it returns.
+	AddVerif(string, UserId, int64) error
+	PopVerif(string) (UserId, int64, error)
+
+	// Drop all of the user's pending verification tokens
+	// (e.g. they were sent to a previous email).
+	RmVerifs(UserId) error
+
+	// Password reset tokens; same semantic as above.
+	AddReset(string, UserId, int64) error
+	PopReset(string) (UserId, int64, error)
+}
+
+// Where sessions are kept (see token.go); SQLiteDB
+// implements it, MemSessions is an in-memory one.
+type SessionStore interface {
+	// Create or update a session
+	SetSession(*Session) error
+
+	// nil, nil if there's no such session
+	GetSession(UserId, string) (*Session, error)
+
+	// uid's sessions, sorted by creation date
+	GetSessions(UserId) ([]Session, error)
+
+	RmSession(UserId, string) error
+	RmSessions(UserId) error
+
+	// Remove sessions expired at the given date
+	ExpireSessions(int64) error
+
+	// Refresh tokens, identified by their hash; the tokens
+	// issued for a session form a family, removed with it
+	// (RmSession(), RmSessions(), ExpireSessions()).
+	AddRefresh(*Refresh) error
+
+	// Mark a refresh token as used, and return it as it was
+	// before (Used is thus true on reuse); nil, nil if there's
+	// no such token.
+	UseRefresh(string) (*Refresh, error)
+}
+
+type Refresh struct {
+	Hash  string
+	UId   UserId
+	SId   string
+	CDate int64
+	Used  bool
+}
+
+// A session is identified by (UId, Id); Uniq changes each
+// time the token is chained.
+type Session struct {
+	UId   UserId
+	Id    string
+	Uniq  string
+	EDate int64
+
+	// Informative: creation/last chain dates, client's
+	// user agent and IP at creation time.
+	CDate int64
+	LDate int64
+	UA    string
+	IP    string
 }
 
 type User struct {
@@ -20,6 +132,19 @@ type User struct {
 	Passwd   string
 	Verified bool
 	CDate    int64
+
+	// Consecutive failed logins, and date until which
+	// the account is locked (see Login())
+	Fails     int
+	LockUntil int64
+}
+
+// Second factor (see totp.go)
+type TOTP struct {
+	UId    UserId
+	Secret string // encrypted
+	Active bool   // enrollment confirmed
+	Last   int64  // last accepted time step (replays)
 }
 
 // this is just so we can have a specific JSON
@@ -43,14 +168,30 @@ type LoginIn struct {
 	// Login is either a User.Name or a User.Email
 	Login  string `json:"login"`
 	Passwd string `json:"passwd"`
+
+	// Opt-in: short-lived token, and a refresh token (/refresh)
+	Refresh bool  `json:"refresh"`
+
+	// Filled by Wrap(), from the HTTP request
+	UA     string `json:"-"`
+	IP     string `json:"-"`
 }
 
+// If the user has enrolled a second factor, there's no
+// Token (yet): Challenge is to be sent to /2fa/login.
 type LoginOut struct {
-	Token  string `json:"token"`
+	Token   string `json:"token"`
+	Refresh string `json:"refresh,omitempty"`
+
+	SecondFactor bool   `json:"second_factor,omitempty"`
+	Challenge    string `json:"challenge,omitempty"`
 }
 
+// All: close all the user's sessions, not only
+// the current one.
 type LogoutIn struct {
 	Token  string `json:"token"`
+	All    bool   `json:"all"`
 }
 
 type LogoutOut struct {
@@ -73,6 +214,15 @@ type ChainOut struct {
 	Token  string `json:"token"`
 }
 
+type RefreshIn struct {
+	Refresh string `json:"refresh"`
+}
+
+type RefreshOut struct {
+	Token   string `json:"token"`
+	Refresh string `json:"refresh"`
+}
+
 type CheckIn struct {
 	Token  string `json:"token"`
 }
@@ -83,8 +233,11 @@ type CheckOut struct {
 
 // NOTE/XXX: This is a "special" token, not the usual JWT
 // token. Perhaps we could still use a JWT token here too.
+//
+// NOTE: not named Token, as it would then be overwritten
+// by the cookie's token (see Wrap()).
 type VerifyIn struct {
-	Token string `json:"token"`
+	Tok string `json:"token"`
 }
 
 // Now this is a genuine token: upon success, we're also
@@ -111,3 +264,104 @@ type EditIn struct {
 type EditOut struct {
 	Token string `json:"token"`
 }
+
+type ForgotIn struct {
+	// Login is either a User.Name or a User.Email
+	Login  string `json:"login"`
+}
+
+type ForgotOut struct {
+}
+
+// NOTE: Tok is a reset token, sent by email (see VerifyIn)
+type ResetIn struct {
+	Tok    string `json:"token"`
+	Passwd string `json:"passwd"`
+}
+
+// All sessions are closed upon reset: Token is always empty.
+type ResetOut struct {
+	Token  string `json:"token"`
+}
+
+type SessionsIn struct {
+	Token  string `json:"token"`
+}
+
+type SessionInfo struct {
+	Id      string `json:"id"`
+	CDate   int64  `json:"cdate"`
+	LDate   int64  `json:"ldate"`
+	UA      string `json:"ua"`
+	IP      string `json:"ip"`
+
+	// Is this the session of the caller?
+	Current bool   `json:"current"`
+}
+
+type SessionsOut struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// Either revoke the session Id, or if All is set, all
+// the sessions but the current one.
+type RevokeSessionsIn struct {
+	Token  string `json:"token"`
+	Id     string `json:"id"`
+	All    bool   `json:"all"`
+}
+
+type RevokeSessionsOut struct {
+}
+
+type TOTPEnrollIn struct {
+	Token  string `json:"token"`
+	Passwd string `json:"passwd"`
+}
+
+// Secret is base32-encoded; URI is an otpauth:// URI
+// (e.g. to be displayed as a QR code).
+type TOTPEnrollOut struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPConfirmIn struct {
+	Token  string `json:"token"`
+	Code   string `json:"code"`
+}
+
+// Recovery codes (see recovery.go), shown only once
+type TOTPConfirmOut struct {
+	Codes  []string `json:"codes"`
+}
+
+// NOTE: Challenge comes from /login (see VerifyIn); Code
+// can also be a recovery code.
+type TOTPLoginIn struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+
+	// Same as LoginIn
+	Refresh bool     `json:"refresh"`
+	UA      string   `json:"-"`
+	IP      string   `json:"-"`
+}
+
+type TOTPRecoveryIn struct {
+	Token  string `json:"token"`
+}
+
+// Remaining recovery codes
+type TOTPRecoveryOut struct {
+	Count  int    `json:"count"`
+}
+
+type TOTPRegenIn struct {
+	Token  string `json:"token"`
+	Passwd string `json:"passwd"`
+}
+
+type TOTPRegenOut struct {
+	Codes  []string `json:"codes"`
+}
@@ -1,20 +1,86 @@
 package auth
 
 import (
-	"math/rand"
+	"crypto/rand"
 )
 
 const (
 	alnum = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ123456789"
 )
 
-// Generate a random string of n bytes
-func randString(n int) string {
+// Generate a random string of n bytes from alnum; those are used
+// as secrets (uniqs, verification tokens, etc.), hence crypto/rand.
+func randString(n int) (string, error) {
+	if n <= 0 {
+		return "", nil
+	}
+
+	// Random bytes >= max are rejected: keeping them would
+	// favor the first 256%len(alnum) characters of alnum.
+	max := 256 - 256%len(alnum)
+
 	buf := make([]byte, n)
+	rnd := make([]byte, n)
 
-	for i := 0; i < n; i++ {
-		buf[i] = alnum[rand.Intn(len(alnum))]
+	for i := 0; i < n; {
+		if _, err := rand.Read(rnd); err != nil {
+			return "", &intErr{"Cannot generate random string: "+err.Error()}
+		}
+		for _, b := range rnd {
+			if i == n {
+				break
+			}
+			if int(b) < max {
+				buf[i] = alnum[int(b)%len(alnum)]
+				i++
+			}
+		}
 	}
 
-	return string(buf)
+	return string(buf), nil
+}
+
+// internal error (500)
+type intErr struct {
+	string
+}
+
+func (e *intErr) Error() string {
+	return e.string
+}
+
+// authentication error (401)
+type authErr struct {
+	string
+}
+
+func (e *authErr) Error() string {
+	return e.string
+}
+
+// forbidden (403)
+type forbidErr struct {
+	string
+}
+
+func (e *forbidErr) Error() string {
+	return e.string
+}
+
+// unsupported media type (415)
+type mediaErr struct {
+	string
+}
+
+func (e *mediaErr) Error() string {
+	return e.string
+}
+
+// too many requests (429)
+type limitErr struct {
+	string
+}
+
+func (e *limitErr) Error() string {
+	return e.string
 }
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"testing"
+	"strings"
+	"github.com/mbivert/ftests"
+)
+
+// Length of randString(n), and whether it only
+// contains alnum characters.
+func randStringLen(n int) (int, bool) {
+	s, err := randString(n)
+	if err != nil {
+		return -1, false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(alnum, c) {
+			return len(s), false
+		}
+	}
+	return len(s), true
+}
+
+// Pearson's chi-squared statistic over the characters of
+// m random strings of length n, assuming an uniform
+// distribution over alnum.
+func randStringChi2(m, n int) float64 {
+	count := map[rune]int{}
+	for i := 0; i < m; i++ {
+		s, err := randString(n)
+		if err != nil {
+			return -1
+		}
+		for _, c := range s {
+			count[c]++
+		}
+	}
+
+	exp := float64(m*n)/float64(len(alnum))
+
+	chi2 := 0.
+	for _, c := range alnum {
+		d := float64(count[c])-exp
+		chi2 += d*d/exp
+	}
+	return chi2
+}
+
+func TestRandString(t *testing.T) {
+	// 56 degrees of freedom: P(chi2 > 115) < 1e-5, while
+	// a biased generator (e.g. random byte%len(alnum))
+	// reaches ~800 here.
+	chi2 := randStringChi2(1000, 64)
+
+	ftests.Run(t, []ftests.Test{
+		{
+			"Negative length",
+			randStringLen,
+			[]any{-1},
+			[]any{0, true},
+		},
+		{
+			"Zero length",
+			randStringLen,
+			[]any{0},
+			[]any{0, true},
+		},
+		{
+			"Single byte",
+			randStringLen,
+			[]any{1},
+			[]any{1, true},
+		},
+		{
+			"Usual length",
+			randStringLen,
+			[]any{64},
+			[]any{64, true},
+		},
+		{
+			"Odd, large length (rejections spanning multiple reads)",
+			randStringLen,
+			[]any{4099},
+			[]any{4099, true},
+		},
+		{
+			"Uniform distribution",
+			func() bool { return chi2 >= 0 && chi2 < 115 },
+			[]any{},
+			[]any{true},
+		},
+	})
+}